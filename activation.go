@@ -0,0 +1,118 @@
+package debora
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+/*
+	Scheduled activation of upgrades.
+	An upgrade message may carry a wall clock time (unix, UTC) and/or an app height.
+	Peers fetch and build right away, into a staging directory,
+	but only swap the binaries in and restart once the condition is met,
+	so the whole network switches over together.
+*/
+
+// How often the app reports its height and debora checks for activation
+var ActivationPollInterval = time.Second
+
+// Does the upgrade carry an activation condition
+func hasActivation(obj UpgradeMsg) bool {
+	return obj.ActivateAt > 0 || obj.ActivateHeight > 0
+}
+
+// Is the activation condition met for the given app height
+func activationReady(obj UpgradeMsg, height int64) bool {
+	if obj.ActivateAt > 0 && time.Now().UTC().Unix() < obj.ActivateAt {
+		return false
+	}
+	if obj.ActivateHeight > 0 && height < obj.ActivateHeight {
+		return false
+	}
+	return true
+}
+
+// Describe the activation condition for logs
+func activationString(obj UpgradeMsg) string {
+	s := ""
+	if obj.ActivateAt > 0 {
+		s += fmt.Sprintf("time %s ", time.Unix(obj.ActivateAt, 0).UTC().Format(time.RFC3339))
+	}
+	if obj.ActivateHeight > 0 {
+		s += fmt.Sprintf("height %d ", obj.ActivateHeight)
+	}
+	return s
+}
+
+// Directory where binaries are built while waiting for activation
+func stagingDir(app string) string {
+	return path.Join(DeboraRoot, "staging", app)
+}
+
+// Directory where the binaries replaced by an activation are kept
+func replacedDir(app string) string {
+	return path.Join(DeboraRoot, "replaced", app)
+}
+
+// Move the staged binaries into place.
+// Returns a function putting back the binaries they replaced,
+// for when the activation fails after all
+func activateStaged(app string) (func(), error) {
+	dir := stagingDir(app)
+	old := replacedDir(app)
+	var moved []string
+	restore := func() {
+		for _, name := range moved {
+			os.Remove(path.Join(GoBin, name))
+			os.Rename(path.Join(old, name), path.Join(GoBin, name))
+		}
+	}
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		// nothing was built, eg. a plain restart
+		return restore, nil
+	} else if err != nil {
+		return restore, err
+	}
+	os.RemoveAll(old)
+	if err := os.MkdirAll(old, 0700); err != nil {
+		return restore, err
+	}
+	for _, f := range files {
+		bin := path.Join(GoBin, f.Name())
+		if err := os.Rename(bin, path.Join(old, f.Name())); err != nil && !os.IsNotExist(err) {
+			return restore, err
+		}
+		moved = append(moved, f.Name())
+		if err := os.Rename(path.Join(dir, f.Name()), bin); err != nil {
+			return restore, err
+		}
+	}
+	return restore, os.RemoveAll(dir)
+}
+
+// Block until the pending upgrade may be activated
+func (deb *Debora) waitActivation(obj UpgradeMsg) {
+	for {
+		if activationReady(obj, deb.Height()) {
+			return
+		}
+		time.Sleep(ActivationPollInterval)
+	}
+}
+
+// Periodically report the app's height to debora.
+// Runs in the app process
+func reportHeight(host string, pid int, height func() int64) {
+	c := NewClient(host)
+	for {
+		if err := c.Height(context.Background(), pid, height()); err != nil {
+			logger.Println("Error reporting height:", err)
+		}
+		time.Sleep(ActivationPollInterval)
+	}
+}
@@ -0,0 +1,215 @@
+package debora
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"time"
+)
+
+/*
+	Prebuilt binary artifacts.
+	Instead of building from source, the upgrade message may name
+	a binary by its sha256 hash and a list of urls (http, https or file).
+	The developer signs the name, the hash, the size and the upgrade's commit with the app's key,
+	so the signature can't be replayed for another binary name or release.
+	Peers download the binary, verify the hash and signature,
+	and atomically swap it into place.
+	If no url yields a valid artifact, peers fall back to building from source.
+*/
+
+// Give up on a download after this long
+var DownloadTimeout = 10 * time.Minute
+
+// Prefix of the bytes signed for an artifact
+const artifactSignPrefix = "debora artifact signature v1\x00"
+
+// A prebuilt binary for the app
+type Artifact struct {
+	Name   string   // binary name, installed into GoBin
+	SHA256 string   // hex encoded sha256 of the binary
+	URLs   []string // where to download the binary
+	Sig    string   // hex encoded signature of the name, hash, size and commit by the developer's key
+	Size   int64    `json:",omitempty"` // size of the binary in bytes
+	Deltas []Delta  `json:",omitempty"` // patches from previous binaries
+
+	Manifest *Manifest `json:",omitempty"` // chunks to fetch from peers
+}
+
+// Create a signed artifact for the binary at file, built from commit.
+// Run by the developer
+func NewArtifact(file, commit, privHex string, urls []string) (*Artifact, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return nil, err
+	}
+	a := &Artifact{
+		Name:   path.Base(file),
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+		URLs:   urls,
+		Size:   size,
+	}
+	sig, err := Sign(privHex, a.signDigest(commit))
+	if err != nil {
+		return nil, err
+	}
+	a.Sig = hex.EncodeToString(sig)
+	return a, nil
+}
+
+// The digest signed for the artifact of the commit
+func (a *Artifact) signDigest(commit string) []byte {
+	var e encoder
+	e.buf.WriteString(artifactSignPrefix)
+	e.string(a.Name)
+	e.string(a.SHA256)
+	e.varint(a.Size)
+	e.string(commit)
+	sum := sha256.Sum256(e.buf.Bytes())
+	return sum[:]
+}
+
+// Check the artifact of the commit is signed by the developer
+func (a *Artifact) verifySig(pubHex, commit string) error {
+	if _, err := hex.DecodeString(a.SHA256); err != nil || len(a.SHA256) != 2*sha256.Size {
+		return fmt.Errorf("Artifact hash is not valid hex: %s", a.SHA256)
+	}
+	sig, err := hex.DecodeString(a.Sig)
+	if err != nil {
+		return fmt.Errorf("Artifact signature is not valid hex")
+	}
+	if err := Verify(pubHex, a.signDigest(commit), sig); err != nil {
+		return fmt.Errorf("Invalid artifact signature: %s", err.Error())
+	}
+	return nil
+}
+
+// Open an artifact url for reading
+func openURL(rawurl string) (io.ReadCloser, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "file":
+		return os.Open(u.Path)
+	case "http", "https":
+		client := &http.Client{Timeout: DownloadTimeout}
+		resp, err := client.Get(rawurl)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode > 399 {
+			resp.Body.Close()
+			return nil, fmt.Errorf("HTTP error %d", resp.StatusCode)
+		}
+		return resp.Body, nil
+	default:
+		return nil, fmt.Errorf("Unsupported url scheme: %s", u.Scheme)
+	}
+}
+
+// Download the artifact from url into a temp file in dir
+// and check its hash. Returns the temp file's name
+func (a *Artifact) download(rawurl, dir string) (string, error) {
+	r, err := openURL(rawurl)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	f, err := ioutil.TempFile(dir, "."+a.Name)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	var src io.Reader = r
+	if a.Size > 0 {
+		// a longer download can't match the hash
+		src = io.LimitReader(r, a.Size+1)
+	}
+	_, err = io.Copy(io.MultiWriter(f, h), src)
+	f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != a.SHA256 {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("Artifact hash mismatch: expected %s, got %s", a.SHA256, sum)
+	}
+	return f.Name(), nil
+}
+
+// The commit an artifact was built from.
+// `debora call` signs artifacts over a full commit hash, which is already resolved.
+// Older messages may name a reference, which must resolve in the local checkout,
+// since there is nothing to fetch
+func (deb *Debora) artifactCommit(src, ref string) (string, error) {
+	if IsCommitHash(ref) {
+		return ref, nil
+	}
+	return deb.resolveRef(src, ref)
+}
+
+// Verify, download and install the artifact of the commit into dir.
+// The binary is swapped in with a rename, so it's never half written
+func (deb *Debora) installArtifact(a *Artifact, commit, dir string) error {
+	if err := a.verifySig(deb.deb.Key, commit); err != nil {
+		return err
+	}
+	if a.Name == "" || a.Name != path.Base(a.Name) {
+		return fmt.Errorf("Invalid artifact name: %s", a.Name)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	// patch the current binary if we can
+	if len(a.Deltas) > 0 {
+		err := deb.installDelta(a, dir)
+		if err == nil {
+			deb.seedChunks(a, path.Join(dir, a.Name))
+			return nil
+		}
+		deb.Logf(fmt.Sprintf("Delta error: %s. Downloading the full artifact\n", err.Error()))
+	}
+	// assemble it from chunks fetched from peers if we can
+	if a.Manifest != nil {
+		err := deb.installChunks(a, dir)
+		if err == nil {
+			return nil
+		}
+		deb.Logf(fmt.Sprintf("Chunk error: %s. Downloading the full artifact\n", err.Error()))
+	}
+	for _, u := range a.URLs {
+		tmp, err := a.download(u, dir)
+		if err != nil {
+			deb.Logf(fmt.Sprintf("Artifact download from %s failed: %s\n", u, err.Error()))
+			continue
+		}
+		if err := os.Chmod(tmp, 0755); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		if err := os.Rename(tmp, path.Join(dir, a.Name)); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		deb.Logf(fmt.Sprintf("Installed artifact %s (%s) from %s\n", a.Name, a.SHA256, u))
+		deb.seedChunks(a, path.Join(dir, a.Name))
+		return nil
+	}
+	return fmt.Errorf("No valid artifact found at %v", a.URLs)
+}
@@ -0,0 +1,180 @@
+package debora
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+/*
+	Configurable build pipelines.
+	By default an app is built with `go install` of its main package.
+	A build spec can add flags and environment to that, eg. -ldflags version stamping,
+	build tags or CGO_ENABLED, or replace it with another command, eg. a make target.
+	The spec is set by the app with SetBuildSpec before Add,
+	or shipped in the repo as BuildSpecFile, which takes precedence
+	since it's versioned with the release.
+	Arguments and environment may refer to the hook variables, eg. $DEBORA_NEW_COMMIT.
+	Build output streams into the upgrade log as the build runs.
+*/
+
+// Build spec file, relative to the root of the checkout
+const BuildSpecFile = ".debora-build.json"
+
+// How to build the app
+type BuildSpec struct {
+	Command []string `json:",omitempty"` // command and args to run instead of `go install`, eg. ["make", "node"]
+	Flags   []string `json:",omitempty"` // extra `go install` flags, eg. ["-tags", "cleveldb"]
+	Env     []string `json:",omitempty"` // extra environment, eg. ["CGO_ENABLED=0"]
+	Output  string   `json:",omitempty"` // built binary, relative to the checkout. Required with Command
+}
+
+// build spec sent to debora in Add
+var buildSpec *BuildSpec
+
+// Set how debora builds the app on upgrades.
+// Must be called before Add
+func SetBuildSpec(spec BuildSpec) {
+	buildSpec = &spec
+}
+
+// Read the build spec shipped in the checkout at dir, if any,
+// falling back to the one given in Add
+func (deb *Debora) loadBuildSpec(dir string) (BuildSpec, error) {
+	b, err := ioutil.ReadFile(path.Join(dir, BuildSpecFile))
+	if os.IsNotExist(err) {
+		if deb.deb.Build != nil {
+			return *deb.deb.Build, nil
+		}
+		return BuildSpec{}, nil
+	} else if err != nil {
+		return BuildSpec{}, err
+	}
+	var spec BuildSpec
+	if err := json.Unmarshal(b, &spec); err != nil {
+		return BuildSpec{}, fmt.Errorf("Bad %s: %s", BuildSpecFile, err.Error())
+	}
+	deb.Logf(fmt.Sprintf("Using build spec from %s\n", BuildSpecFile))
+	return spec, nil
+}
+
+// Expand $VARS in s from the hook environment, then the process environment
+func expandEnv(s string, env HookEnv) string {
+	vars := make(map[string]string)
+	for _, kv := range env.Environ() {
+		spl := strings.SplitN(kv, "=", 2)
+		vars[spl[0]] = spl[1]
+	}
+	return os.Expand(s, func(k string) string {
+		if v, ok := vars[k]; ok {
+			return v
+		}
+		return os.Getenv(k)
+	})
+}
+
+func expandAll(list []string, env HookEnv) []string {
+	out := make([]string, len(list))
+	for i, s := range list {
+		out[i] = expandEnv(s, env)
+	}
+	return out
+}
+
+// Build the app checked out at dir according to its build spec,
+// and install the binary into gobin (or GoBin).
+// The binary is built in a scratch dir, and only moved into place
+// once it matches the developer's attested hash, if there is one.
+// Returns the binary's name
+func (deb *Debora) buildApp(dir, gobin string, env HookEnv, reqObj UpgradeMsg) (string, error) {
+	spec, err := deb.loadBuildSpec(dir)
+	if err != nil {
+		return "", err
+	}
+	buildEnv := append(deb.moduleEnv(dir), env.Environ()...)
+	buildEnv = append(buildEnv, expandAll(spec.Env, env)...)
+	if reqObj.Toolchain != "" {
+		buildEnv = append(buildEnv, "GOTOOLCHAIN="+reqObj.Toolchain)
+	}
+	flags := expandAll(spec.Flags, env)
+	if reqObj.BinarySHA256 != "" {
+		flags = append(append([]string{}, ReproducibleFlags...), flags...)
+	}
+
+	scratch := path.Join(DeboraRoot, "build", deb.deb.App)
+	os.RemoveAll(scratch)
+	defer os.RemoveAll(scratch)
+
+	// build
+	var bin string
+	if len(spec.Command) == 0 {
+		if err := goInstall(dir, deb.deb.Pkg, scratch, deb.logWriter(), buildEnv, flags...); err != nil {
+			return "", err
+		}
+		files, err := ioutil.ReadDir(scratch)
+		if err != nil {
+			return "", err
+		}
+		if len(files) != 1 {
+			return "", fmt.Errorf("Expected one binary from the build, got %d", len(files))
+		}
+		bin = path.Join(scratch, files[0].Name())
+	} else {
+		if spec.Output == "" {
+			return "", fmt.Errorf("Build spec with a command must give its output")
+		}
+		args := expandAll(spec.Command, env)
+		deb.Logf(fmt.Sprintf("Building with %s\n", strings.Join(args, " ")))
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), buildEnv...)
+		cmd.Stdout = deb.logWriter()
+		cmd.Stderr = deb.logWriter()
+		if err := cmd.Run(); err != nil {
+			return "", err
+		}
+		bin = path.Join(dir, expandEnv(spec.Output, env))
+	}
+
+	// verify
+	if reqObj.BinarySHA256 != "" {
+		sum, err := fileSHA256(bin)
+		if err != nil {
+			return "", err
+		}
+		if sum != reqObj.BinarySHA256 {
+			return "", fmt.Errorf("Binary hash mismatch: developer attested %s, built %s", reqObj.BinarySHA256, sum)
+		}
+		deb.Logf(fmt.Sprintf("Binary %s matches the attested hash %s\n", path.Base(bin), sum))
+	}
+
+	// install
+	if gobin == "" {
+		gobin = GoBin
+	}
+	if err := os.MkdirAll(gobin, 0700); err != nil {
+		return "", err
+	}
+	return path.Base(bin), installFile(bin, path.Join(gobin, path.Base(bin)))
+}
+
+// Copy a file into place, with a rename so it's never half written
+func installFile(from, to string) error {
+	b, err := ioutil.ReadFile(from)
+	if err != nil {
+		return err
+	}
+	tmp := to + ".debora-tmp"
+	if err := ioutil.WriteFile(tmp, b, 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, to); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
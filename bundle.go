@@ -0,0 +1,152 @@
+package debora
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+/*
+	Offline upgrades from git bundles.
+	Peers that can't reach origin can fetch the new commits
+	from a git bundle instead. The bundle is attached to the upgrade
+	message, so it travels over the app's own p2p layer,
+	or named by urls (eg. file:// on a shared disk).
+	The developer signs the bundle's sha256 and the upgrade's commit with the app's key,
+	like an artifact, so the signature can't be replayed for another release.
+	Peers verify the hash, the signature and the bundle's prerequisites
+	before fetching from it. Fetching never moves an existing tag.
+*/
+
+// Prefix of the bytes signed for a bundle
+const bundleSignPrefix = "debora bundle signature v1\x00"
+
+// A git bundle covering the new commits
+type Bundle struct {
+	SHA256 string   // hex encoded sha256 of the bundle
+	Sig    string   // hex encoded signature of the hash and commit by the developer's key
+	Data   []byte   `json:",omitempty"` // the bundle itself, if attached
+	URLs   []string `json:",omitempty"` // where to get the bundle otherwise
+}
+
+// Create a signed bundle for the git bundle at file, for the upgrade to commit.
+// With no urls, the bundle is attached to the message.
+// Run by the developer
+func NewBundle(file, commit, privHex string, urls []string) (*Bundle, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(data)
+	b := &Bundle{
+		SHA256: hex.EncodeToString(digest[:]),
+		URLs:   urls,
+	}
+	sig, err := Sign(privHex, b.signDigest(commit))
+	if err != nil {
+		return nil, err
+	}
+	b.Sig = hex.EncodeToString(sig)
+	if len(urls) == 0 {
+		b.Data = data
+	}
+	return b, nil
+}
+
+// The digest signed for the bundle of the upgrade to commit
+func (b *Bundle) signDigest(commit string) []byte {
+	var e encoder
+	e.buf.WriteString(bundleSignPrefix)
+	e.string(b.SHA256)
+	e.string(commit)
+	sum := sha256.Sum256(e.buf.Bytes())
+	return sum[:]
+}
+
+// Check the bundle of the upgrade to commit is signed by the developer
+func (b *Bundle) verifySig(pubHex, commit string) error {
+	if _, err := hex.DecodeString(b.SHA256); err != nil || len(b.SHA256) != 2*sha256.Size {
+		return fmt.Errorf("Bundle hash is not valid hex: %s", b.SHA256)
+	}
+	sig, err := hex.DecodeString(b.Sig)
+	if err != nil {
+		return fmt.Errorf("Bundle signature is not valid hex")
+	}
+	if err := Verify(pubHex, b.signDigest(commit), sig); err != nil {
+		return fmt.Errorf("Invalid bundle signature: %s", err.Error())
+	}
+	return nil
+}
+
+// The bundle's contents, from the message or the first url that works,
+// checked against its hash
+func (deb *Debora) bundleData(b *Bundle) ([]byte, error) {
+	check := func(data []byte) error {
+		sum := sha256.Sum256(data)
+		if s := hex.EncodeToString(sum[:]); s != b.SHA256 {
+			return fmt.Errorf("Bundle hash mismatch: expected %s, got %s", b.SHA256, s)
+		}
+		return nil
+	}
+	if len(b.Data) > 0 {
+		return b.Data, check(b.Data)
+	}
+	for _, u := range b.URLs {
+		r, err := openURL(u)
+		if err != nil {
+			deb.Logf(fmt.Sprintf("Bundle download from %s failed: %s\n", u, err.Error()))
+			continue
+		}
+		buf := new(bytes.Buffer)
+		_, err = io.Copy(buf, r)
+		r.Close()
+		if err == nil {
+			err = check(buf.Bytes())
+		}
+		if err != nil {
+			deb.Logf(fmt.Sprintf("Bundle download from %s failed: %s\n", u, err.Error()))
+			continue
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("No valid bundle found")
+}
+
+// Verify the bundle of the upgrade to commit and fetch its branches
+// and tags into src's repo, as if they were fetched from origin.
+// Tags we already have are left alone
+func (deb *Debora) fetchBundle(app, src, commit string, b *Bundle) error {
+	if err := b.verifySig(deb.deb.Key, commit); err != nil {
+		return err
+	}
+	data, err := deb.bundleData(b)
+	if err != nil {
+		return err
+	}
+	dir := path.Join(DeboraRoot, "bundles", app)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	file := path.Join(dir, b.SHA256+".bundle")
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		return err
+	}
+	defer os.Remove(file)
+
+	// make sure we have the commits the bundle builds on
+	if _, err := deb.git(src, "bundle", "verify", file); err != nil {
+		return err
+	}
+	out, err := deb.git(src, "fetch", file, "+refs/heads/*:refs/remotes/origin/*", "refs/tags/*:refs/tags/*")
+	if err != nil {
+		return err
+	}
+	deb.Logf(out)
+	deb.Logf(fmt.Sprintf("Fetched from bundle %s\n", b.SHA256))
+	return nil
+}
@@ -0,0 +1,38 @@
+package debora
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+// A bundle's signature holds only for the upgrade it was made for
+func TestBundleSig(t *testing.T) {
+	priv, pub := testKey(t, 0)
+	file := path.Join(t.TempDir(), "release.bundle")
+	if err := ioutil.WriteFile(file, []byte("# v2 git bundle\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewBundle(file, "v1.4.2", priv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.verifySig(pub, "v1.4.2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.verifySig(pub, "v1.4.3"); err == nil {
+		t.Fatal("the signature was replayed for another commit")
+	}
+	// nor does a bare signature of the hash, as bundles were signed before
+	digest, _ := hex.DecodeString(b.SHA256)
+	sig, err := Sign(priv, digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := *b
+	old.Sig = hex.EncodeToString(sig)
+	if err := old.verifySig(pub, "v1.4.2"); err == nil {
+		t.Fatal("accepted an unprefixed signature")
+	}
+}
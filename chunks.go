@@ -0,0 +1,429 @@
+package debora
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+/*
+	Peer-assisted artifact distribution.
+	An artifact may carry a manifest splitting it into content-addressed chunks.
+	The manifest's root, the hash of its chunk hashes, is signed by the developer.
+	Apps exchange chunks over their own p2p layer: they give debora
+	a function to send messages with SetChunkSender, and hand her the
+	messages they receive with HandleChunkMessage, like they do with Call.
+	Chunks live in a store under the debora root shared by the app and its daemon,
+	so the daemon assembles the artifact from chunks fetched by the app,
+	and the app serves the chunks of artifacts its daemon installed.
+	If no new chunk arrives for ChunkTimeout, the daemon falls back to the artifact's urls.
+*/
+
+var (
+	ChunkSize         = 256 * 1024      // size of chunks made by NewManifest
+	ChunkTimeout      = 1 * time.Minute // give up on peers if no chunk arrives for this long
+	ChunkPollInterval = 5 * time.Second // how often to ask peers for missing chunks
+	ChunkRetention    = 7 * 24 * time.Hour
+)
+
+// Chunks of an artifact
+type Manifest struct {
+	Size      int64
+	ChunkSize int
+	Chunks    []string // hex encoded sha256 of each chunk, in order
+	Root      string   // hex encoded sha256 of the concatenated chunk hashes
+	Sig       string   // hex encoded signature of the root by the developer's key
+}
+
+// Chunk messages exchanged by peers
+const (
+	ChunkMsgHave  = "have"  // the sender has these chunks
+	ChunkMsgWant  = "want"  // the sender wants these chunks
+	ChunkMsgChunk = "chunk" // a chunk the receiver wanted
+)
+
+// A message between peers' chunk stores
+type ChunkMsg struct {
+	Type   string
+	Hashes []string `json:",omitempty"`
+	Data   []byte   `json:",omitempty"` // for chunk messages, the chunk with Hashes[0]
+}
+
+// A peer's chunk store, and the chunks it is fetching
+type chunkStore struct {
+	dir string // defaults to chunksDir()
+
+	// sends a message to a peer, or to all peers if peer is empty.
+	// set by the app
+	send func(peer string, msg []byte)
+
+	mtx    sync.Mutex
+	wanted map[string]bool // chunks we're fetching
+}
+
+// The store shared by the app and its daemon
+var localChunks = newChunkStore("")
+
+func newChunkStore(dir string) *chunkStore {
+	return &chunkStore{dir: dir, wanted: make(map[string]bool)}
+}
+
+func chunksDir() string {
+	return path.Join(DeboraRoot, "chunks")
+}
+
+func (s *chunkStore) root() string {
+	if s.dir != "" {
+		return s.dir
+	}
+	return chunksDir()
+}
+
+// Chunks are named by their hex encoded sha256.
+// Peers' hashes must be checked, as they become file names
+func isChunkHash(hash string) bool {
+	b, err := hex.DecodeString(hash)
+	return err == nil && len(b) == sha256.Size
+}
+
+func (s *chunkStore) path(hash string) string {
+	return path.Join(s.root(), hash)
+}
+
+func (s *chunkStore) has(hash string) bool {
+	_, err := os.Stat(s.path(hash))
+	return err == nil
+}
+
+// Add a chunk to the store, if it matches its hash
+func (s *chunkStore) put(hash string, data []byte) error {
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != hash {
+		return fmt.Errorf("Chunk hash mismatch")
+	}
+	if err := os.MkdirAll(s.root(), 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(s.root(), ".chunk")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	f.Close()
+	if err == nil {
+		err = os.Rename(f.Name(), s.path(hash))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Split the file into chunks, adding them to the store.
+// Returns the chunks' hashes
+func (s *chunkStore) storeFile(file string, size int) ([]string, int64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	var hashes []string
+	var total int64
+	buf := make([]byte, size)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			sum := sha256.Sum256(buf[:n])
+			hash := hex.EncodeToString(sum[:])
+			if !s.has(hash) {
+				if err := s.put(hash, buf[:n]); err != nil {
+					return nil, 0, err
+				}
+			}
+			hashes = append(hashes, hash)
+			total += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return hashes, total, nil
+		} else if err != nil {
+			return nil, 0, err
+		}
+	}
+}
+
+func manifestRoot(chunks []string) []byte {
+	h := sha256.New()
+	for _, c := range chunks {
+		b, _ := hex.DecodeString(c)
+		h.Write(b)
+	}
+	return h.Sum(nil)
+}
+
+// Create a signed manifest for the binary at file.
+// Its chunks are added to the local store, so the developer's own peer can serve them.
+// Run by the developer
+func NewManifest(file, privHex string) (*Manifest, error) {
+	return localChunks.newManifest(file, privHex)
+}
+
+func (s *chunkStore) newManifest(file, privHex string) (*Manifest, error) {
+	chunks, size, err := s.storeFile(file, ChunkSize)
+	if err != nil {
+		return nil, err
+	}
+	root := manifestRoot(chunks)
+	sig, err := Sign(privHex, root)
+	if err != nil {
+		return nil, err
+	}
+	return &Manifest{
+		Size:      size,
+		ChunkSize: ChunkSize,
+		Chunks:    chunks,
+		Root:      hex.EncodeToString(root),
+		Sig:       hex.EncodeToString(sig),
+	}, nil
+}
+
+// Check the chunks match the root, and the root is signed by the developer
+func (m *Manifest) verify(pubHex string) error {
+	if m.ChunkSize <= 0 || int64(len(m.Chunks)) != (m.Size+int64(m.ChunkSize)-1)/int64(m.ChunkSize) {
+		return fmt.Errorf("Manifest chunks don't match its size")
+	}
+	root := manifestRoot(m.Chunks)
+	if hex.EncodeToString(root) != m.Root {
+		return fmt.Errorf("Manifest root mismatch")
+	}
+	sig, err := hex.DecodeString(m.Sig)
+	if err != nil {
+		return fmt.Errorf("Manifest signature is not valid hex")
+	}
+	if err := Verify(pubHex, root, sig); err != nil {
+		return fmt.Errorf("Invalid manifest signature: %s", err.Error())
+	}
+	return nil
+}
+
+// The manifest's chunks not yet in the store
+func (s *chunkStore) missing(m *Manifest) []string {
+	var list []string
+	for _, c := range m.Chunks {
+		if !s.has(c) && !isIn(c, list) {
+			list = append(list, c)
+		}
+	}
+	return list
+}
+
+// Write the manifest's chunks, in order, into a temp file in dir.
+// Returns the temp file's name
+func (s *chunkStore) assemble(m *Manifest, dir, name string) (string, error) {
+	f, err := ioutil.TempFile(dir, "."+name)
+	if err != nil {
+		return "", err
+	}
+	for _, c := range m.Chunks {
+		data, err := ioutil.ReadFile(s.path(c))
+		if err == nil {
+			_, err = f.Write(data)
+		}
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return "", err
+		}
+	}
+	f.Close()
+	return f.Name(), nil
+}
+
+// Set the function debora uses to send chunk messages over the app's p2p layer.
+// An empty peer means all peers
+func SetChunkSender(send func(peer string, msg []byte)) {
+	localChunks.send = send
+}
+
+func (s *chunkStore) sendMsg(peer string, msg ChunkMsg) {
+	if s.send == nil {
+		return
+	}
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	s.send(peer, b)
+}
+
+// Handle a chunk message the app received from a peer.
+// Call this function when a message sent with the chunk sender arrives
+func HandleChunkMessage(peer string, payload []byte) error {
+	return localChunks.handle(peer, payload)
+}
+
+func (s *chunkStore) handle(peer string, payload []byte) error {
+	var msg ChunkMsg
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return err
+	}
+	switch msg.Type {
+	case ChunkMsgWant:
+		// serve the chunks we have
+		for _, h := range msg.Hashes {
+			if !isChunkHash(h) {
+				continue
+			}
+			data, err := ioutil.ReadFile(s.path(h))
+			if err != nil {
+				continue
+			}
+			s.sendMsg(peer, ChunkMsg{Type: ChunkMsgChunk, Hashes: []string{h}, Data: data})
+		}
+	case ChunkMsgHave:
+		// ask for those we're missing
+		var want []string
+		s.mtx.Lock()
+		for _, h := range msg.Hashes {
+			if s.wanted[h] {
+				want = append(want, h)
+			}
+		}
+		s.mtx.Unlock()
+		if len(want) > 0 {
+			s.sendMsg(peer, ChunkMsg{Type: ChunkMsgWant, Hashes: want})
+		}
+	case ChunkMsgChunk:
+		if len(msg.Hashes) != 1 {
+			return fmt.Errorf("Chunk message must have one hash")
+		}
+		h := msg.Hashes[0]
+		s.mtx.Lock()
+		ok := s.wanted[h]
+		s.mtx.Unlock()
+		if !ok {
+			return nil
+		}
+		if err := s.put(h, msg.Data); err != nil {
+			return err
+		}
+		s.mtx.Lock()
+		delete(s.wanted, h)
+		s.mtx.Unlock()
+	default:
+		return fmt.Errorf("Unknown chunk message %s", msg.Type)
+	}
+	return nil
+}
+
+// Fetch the manifest's chunks from peers, run by the app.
+// Peers are asked for the missing chunks until they all arrive
+// or none arrives for ChunkTimeout. Once done, the chunks are
+// announced to peers, so they can fetch from us
+func fetchChunks(m *Manifest) {
+	localChunks.fetch(m)
+}
+
+func (s *chunkStore) fetch(m *Manifest) {
+	if s.send == nil {
+		return
+	}
+	missing := s.missing(m)
+	s.mtx.Lock()
+	for _, h := range missing {
+		s.wanted[h] = true
+	}
+	s.mtx.Unlock()
+	defer func() {
+		s.mtx.Lock()
+		for _, h := range missing {
+			delete(s.wanted, h)
+		}
+		s.mtx.Unlock()
+	}()
+
+	last := time.Now()
+	for left := missing; len(left) > 0; {
+		if time.Since(last) > ChunkTimeout {
+			logger.Printf("Giving up on %d chunks\n", len(left))
+			return
+		}
+		s.sendMsg("", ChunkMsg{Type: ChunkMsgWant, Hashes: left})
+		time.Sleep(ChunkPollInterval)
+		if l := s.missing(m); len(l) < len(left) {
+			last = time.Now()
+			left = l
+		}
+	}
+	s.sendMsg("", ChunkMsg{Type: ChunkMsgHave, Hashes: m.Chunks})
+}
+
+// Install the artifact into dir from chunks fetched by the app, run by the daemon.
+// Waits while chunks keep arriving
+func (deb *Debora) installChunks(a *Artifact, dir string) error {
+	m := a.Manifest
+	if err := m.verify(deb.deb.Key); err != nil {
+		return err
+	}
+	last := time.Now()
+	left := len(localChunks.missing(m))
+	for left > 0 {
+		if time.Since(last) > ChunkTimeout {
+			return fmt.Errorf("Timed out with %d of %d chunks missing", left, len(m.Chunks))
+		}
+		time.Sleep(ChunkPollInterval)
+		if l := len(localChunks.missing(m)); l < left {
+			last = time.Now()
+			left = l
+		}
+	}
+
+	tmp, err := localChunks.assemble(m, dir, a.Name)
+	if err != nil {
+		return err
+	}
+	if sum, err := fileSHA256(tmp); err != nil || sum != a.SHA256 {
+		os.Remove(tmp)
+		return fmt.Errorf("Assembled artifact does not match its hash")
+	}
+	if err := os.Chmod(tmp, 0755); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path.Join(dir, a.Name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	deb.Logf(fmt.Sprintf("Installed artifact %s (%s) from %d chunks\n", a.Name, a.SHA256, len(m.Chunks)))
+	return nil
+}
+
+// Add an installed artifact's chunks to the store, so the app can serve them,
+// and remove chunks older than ChunkRetention
+func (deb *Debora) seedChunks(a *Artifact, file string) {
+	if a.Manifest == nil {
+		return
+	}
+	chunks, _, err := localChunks.storeFile(file, a.Manifest.ChunkSize)
+	if err != nil {
+		deb.Logf(fmt.Sprintf("Could not store the artifact's chunks: %s\n", err.Error()))
+	} else if !bytes.Equal(manifestRoot(chunks), manifestRoot(a.Manifest.Chunks)) {
+		deb.Logf("The artifact's chunks don't match its manifest\n")
+	}
+	files, err := ioutil.ReadDir(localChunks.root())
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if time.Since(f.ModTime()) > ChunkRetention && !isIn(f.Name(), a.Manifest.Chunks) {
+			os.Remove(path.Join(localChunks.root(), f.Name()))
+		}
+	}
+}
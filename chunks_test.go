@@ -0,0 +1,286 @@
+package debora
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"path"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	testKeysOnce sync.Once
+	testKeys     [2][2]string // private and public keys
+)
+
+// One of two keys, generated once for all tests
+func testKey(t testing.TB, i int) (string, string) {
+	testKeysOnce.Do(func() {
+		for j := range testKeys {
+			k, err := GenerateKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if testKeys[j][0], testKeys[j][1], err = EncodeKey(k); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	return testKeys[i][0], testKeys[i][1]
+}
+
+// Set a package variable for the rest of the test
+func setDuration(t *testing.T, v *time.Duration, d time.Duration) {
+	old := *v
+	*v = d
+	t.Cleanup(func() { *v = old })
+}
+
+// A message in flight between two peers
+type testPacket struct {
+	from    string
+	payload []byte
+}
+
+// An in-memory network. Peers are named by their index,
+// and send to all their neighbors when the peer is empty
+type testNet struct {
+	inbox []chan testPacket
+	nbrs  [][]int
+	done  chan struct{}
+}
+
+func newTestNet(n int, nbrs func(i int) []int) *testNet {
+	net := &testNet{
+		inbox: make([]chan testPacket, n),
+		nbrs:  make([][]int, n),
+		done:  make(chan struct{}),
+	}
+	for i := range net.inbox {
+		net.inbox[i] = make(chan testPacket, 64)
+		net.nbrs[i] = nbrs(i)
+	}
+	return net
+}
+
+// The send function of peer i
+func (net *testNet) sender(i int) func(peer string, msg []byte) {
+	return func(peer string, msg []byte) {
+		to := net.nbrs[i]
+		if peer != "" {
+			j, err := strconv.Atoi(peer)
+			if err != nil {
+				return
+			}
+			to = []int{j}
+		}
+		for _, j := range to {
+			go func(j int) {
+				select {
+				case net.inbox[j] <- testPacket{from: strconv.Itoa(i), payload: msg}:
+				case <-net.done:
+				}
+			}(j)
+		}
+	}
+}
+
+// Hand peer i's messages to handle until the network is closed
+func (net *testNet) serve(i int, handle func(peer string, msg []byte)) {
+	go func() {
+		for {
+			select {
+			case p := <-net.inbox[i]:
+				handle(p.from, p.payload)
+			case <-net.done:
+				return
+			}
+		}
+	}()
+}
+
+func (net *testNet) close() {
+	close(net.done)
+}
+
+// Write size random bytes to a file in dir
+func testBinary(t *testing.T, dir string, size int) (string, []byte) {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	file := path.Join(dir, "node")
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file, data
+}
+
+// Twelve peers fetch an artifact's chunks from one seed and from each other,
+// while one peer answers every request with bad data
+func TestChunksMesh(t *testing.T) {
+	const peers = 12
+	const bad = peers - 1
+	setDuration(t, &ChunkPollInterval, 10*time.Millisecond)
+	setDuration(t, &ChunkTimeout, 10*time.Second)
+	oldSize := ChunkSize
+	ChunkSize = 1024
+	defer func() { ChunkSize = oldSize }()
+
+	priv, pub := testKey(t, 0)
+	tmp := t.TempDir()
+	file, data := testBinary(t, tmp, 20*1024+100)
+
+	// a ring, with chords so the bad peer isn't anyone's only way in
+	net := newTestNet(peers, func(i int) []int {
+		return []int{(i + 1) % peers, (i + peers - 1) % peers, (i + 3) % peers, (i + peers - 3) % peers}
+	})
+	defer net.close()
+
+	var mtx sync.Mutex
+	rejected := 0
+	stores := make([]*chunkStore, peers)
+	for i := range stores {
+		stores[i] = newChunkStore(path.Join(tmp, "peer"+strconv.Itoa(i)))
+		stores[i].send = net.sender(i)
+		s := stores[i]
+		if i == bad {
+			net.serve(i, func(peer string, msg []byte) {
+				var m ChunkMsg
+				if json.Unmarshal(msg, &m) != nil || m.Type != ChunkMsgWant {
+					return
+				}
+				for _, h := range m.Hashes {
+					s.sendMsg(peer, ChunkMsg{Type: ChunkMsgChunk, Hashes: []string{h}, Data: []byte("bad chunk")})
+				}
+			})
+			continue
+		}
+		net.serve(i, func(peer string, msg []byte) {
+			if err := s.handle(peer, msg); err != nil {
+				mtx.Lock()
+				rejected++
+				mtx.Unlock()
+			}
+		})
+	}
+
+	m, err := stores[0].newManifest(file, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.verify(pub); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Chunks) != 21 {
+		t.Fatalf("expected 21 chunks, got %d", len(m.Chunks))
+	}
+
+	var wg sync.WaitGroup
+	for i := 1; i < bad; i++ {
+		wg.Add(1)
+		go func(s *chunkStore) {
+			defer wg.Done()
+			s.fetch(m)
+		}(stores[i])
+	}
+	wg.Wait()
+
+	for i := 1; i < bad; i++ {
+		s := stores[i]
+		if left := s.missing(m); len(left) > 0 {
+			t.Fatalf("peer %d is missing %d chunks", i, len(left))
+		}
+		out, err := s.assemble(m, tmp, "node")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("peer %d assembled a different binary", i)
+		}
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	if rejected == 0 {
+		t.Fatal("no bad chunk was rejected")
+	}
+}
+
+func TestChunkStoreRejectsBadChunk(t *testing.T) {
+	s := newChunkStore(t.TempDir())
+	hash := "8a5edab282632443219e051e4ade2d1d5bbc671c781051bf1437897cbdfea0f1"
+	s.wanted[hash] = true
+	msg, _ := json.Marshal(ChunkMsg{Type: ChunkMsgChunk, Hashes: []string{hash}, Data: []byte("not it")})
+	if err := s.handle("1", msg); err == nil {
+		t.Fatal("accepted a chunk that doesn't match its hash")
+	}
+	if s.has(hash) {
+		t.Fatal("stored a bad chunk")
+	}
+
+	// peers' hashes become file names
+	msg, _ = json.Marshal(ChunkMsg{Type: ChunkMsgWant, Hashes: []string{"../../etc/passwd"}})
+	sent := false
+	s.send = func(peer string, msg []byte) { sent = true }
+	if err := s.handle("1", msg); err != nil || sent {
+		t.Fatal("served a chunk outside the store")
+	}
+}
+
+func TestManifestVerify(t *testing.T) {
+	priv, pub := testKey(t, 0)
+	otherPriv, _ := testKey(t, 1)
+	tmp := t.TempDir()
+	file, _ := testBinary(t, tmp, 3*ChunkSize+1)
+	s := newChunkStore(path.Join(tmp, "chunks"))
+
+	m, err := s.newManifest(file, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.verify(pub); err != nil {
+		t.Fatal(err)
+	}
+
+	// a chunk that isn't in the signed root
+	bad := *m
+	bad.Chunks = append([]string{}, m.Chunks...)
+	bad.Chunks[1] = m.Chunks[0]
+	if err := bad.verify(pub); err == nil {
+		t.Fatal("accepted a manifest whose chunks don't match its root")
+	}
+
+	// a root that isn't signed
+	bad = *m
+	bad.Root = m.Chunks[0]
+	if err := bad.verify(pub); err == nil {
+		t.Fatal("accepted a manifest with a bad root")
+	}
+
+	// signed by someone else
+	other, err := s.newManifest(file, otherPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.verify(pub); err == nil {
+		t.Fatal("accepted a manifest signed by another key")
+	}
+	bad = *m
+	bad.Sig = "zz"
+	if err := bad.verify(pub); err == nil {
+		t.Fatal("accepted a manifest with a malformed signature")
+	}
+
+	// chunks that don't cover the size
+	bad = *m
+	bad.Size += int64(ChunkSize)
+	if err := bad.verify(pub); err == nil {
+		t.Fatal("accepted a manifest whose size doesn't match its chunks")
+	}
+}
@@ -0,0 +1,284 @@
+package debora
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/*
+	Client for the daemon's API, used by the app and the command line.
+	Every method takes a context, and each attempt is also bounded by the client's Timeout,
+	except for calls and rollbacks, which may build and restart the app and are bounded by CallTimeout.
+	Tunnel and hook polls wait for up to TunnelPollTimeout and HookPollTimeout on top of it.
+	Routes that are safe to repeat (ping, known, add, height, status) are retried
+	with exponential backoff on connection errors and 5xx responses.
+	Error responses from the daemon are returned as an *APIError.
+*/
+
+const (
+	DefaultTimeout     = 10 * time.Second
+	DefaultCallTimeout = 30 * time.Minute
+	DefaultRetries     = 3
+	DefaultBackoff     = 100 * time.Millisecond
+)
+
+// Client of a debora daemon
+type Client struct {
+	Host        string        // daemon's address (host:port)
+	Timeout     time.Duration // for each attempt. 0 means no timeout
+	CallTimeout time.Duration // for calls and rollbacks. 0 means no timeout
+	Retries     int           // extra attempts for routes that are safe to repeat
+	Backoff     time.Duration // wait before the first retry, doubling for each one after
+
+	HTTP *http.Client // defaults to http.DefaultClient
+}
+
+// Create a client of the daemon at host, with the default timeout and retries
+func NewClient(host string) *Client {
+	return &Client{
+		Host:        host,
+		Timeout:     DefaultTimeout,
+		CallTimeout: DefaultCallTimeout,
+		Retries:     DefaultRetries,
+		Backoff:     DefaultBackoff,
+	}
+}
+
+// Create a client of the daemon running the app
+func NewAppClient(app string) (*Client, error) {
+	host, err := ResolveHost(app)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(host), nil
+}
+
+// An error response from the daemon
+type APIError struct {
+	Route   string
+	Status  int    // http status code
+	Message string // the ErrorResponse's error, or the body if it had none
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s: %s (HTTP %d)", e.Route, e.Message, e.Status)
+}
+
+// Check the daemon is up
+func (c *Client) Ping(ctx context.Context) error {
+	_, err := c.retry(ctx, "ping", nil)
+	return err
+}
+
+// Stop the daemon
+func (c *Client) Kill(ctx context.Context) error {
+	_, err := c.post(ctx, "kill", nil, c.Timeout)
+	return err
+}
+
+// Have the daemon start the app for the first time
+func (c *Client) Start(ctx context.Context, req StartRequest) error {
+	req.Version = ProtocolVersion
+	return c.send(ctx, "start", req, nil, false)
+}
+
+// Hand the app over to the daemon, who restarts it once it exits
+func (c *Client) Restart(ctx context.Context, req RestartRequest) error {
+	req.Version = ProtocolVersion
+	return c.send(ctx, "restart", req, nil, false)
+}
+
+// Register an app process with the daemon
+func (c *Client) Add(ctx context.Context, req AddRequest) error {
+	req.Version = ProtocolVersion
+	return c.send(ctx, "add", req, nil, true)
+}
+
+// Whether the process has been added to the daemon
+func (c *Client) Known(ctx context.Context, pid int) (bool, error) {
+	b, err := json.Marshal(KnownRequest{Version: ProtocolVersion, Pid: pid})
+	if err != nil {
+		return false, err
+	}
+	b, err = c.retry(ctx, "known", b)
+	if e, ok := err.(*APIError); ok && e.Status == http.StatusNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	// older daemons answer a known process with a plain "ok".
+	// an empty answer says nothing, so the process isn't known
+	if len(bytes.TrimSpace(b)) == 0 {
+		return false, nil
+	}
+	var resp KnownResponse
+	if json.Unmarshal(b, &resp) != nil {
+		return true, nil
+	}
+	return resp.Known, nil
+}
+
+// Report the app's height
+func (c *Client) Height(ctx context.Context, pid int, height int64) error {
+	return c.send(ctx, "height", HeightRequest{Version: ProtocolVersion, Pid: pid, Height: height}, nil, true)
+}
+
+// Hand the daemon an upgrade message.
+// Returns once the upgrade is scheduled, or has failed.
+// If the upgrade goes through, the app is stopped before this returns
+func (c *Client) Call(ctx context.Context, req CallRequest) error {
+	req.Version = ProtocolVersion
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	_, err = c.post(ctx, "call", b, c.CallTimeout)
+	return err
+}
+
+// Hand back replies from the developer, or if there are none,
+// wait for requests to send to the developer through the app's p2p layer
+func (c *Client) Tunnel(ctx context.Context, req TunnelPoll) (*TunnelPollResponse, error) {
+	req.Version = ProtocolVersion
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	timeout := c.Timeout
+	if timeout > 0 {
+		timeout += TunnelPollTimeout
+	}
+	if b, err = c.post(ctx, "tunnel", b, timeout); err != nil {
+		return nil, err
+	}
+	resp := new(TunnelPollResponse)
+	return resp, json.Unmarshal(b, resp)
+}
+
+// Hand back the result of the app's callbacks, and wait for the next stage to run them at
+func (c *Client) Hook(ctx context.Context, req HookPoll) (*HookPollResponse, error) {
+	req.Version = ProtocolVersion
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	timeout := c.Timeout
+	if timeout > 0 {
+		timeout += HookPollTimeout
+	}
+	if b, err = c.post(ctx, "hook", b, timeout); err != nil {
+		return nil, err
+	}
+	resp := new(HookPollResponse)
+	return resp, json.Unmarshal(b, resp)
+}
+
+// The app and any pending upgrade
+func (c *Client) Status(ctx context.Context) (*Status, error) {
+	status := new(Status)
+	if err := c.send(ctx, "status", nil, status, true); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// Switch the app back to a stored binary, by default the one before the current one,
+// and restart it
+func (c *Client) Rollback(ctx context.Context, commit string) (*RollbackResponse, error) {
+	b, err := json.Marshal(RollbackRequest{Version: ProtocolVersion, Commit: commit})
+	if err != nil {
+		return nil, err
+	}
+	if b, err = c.post(ctx, "rollback", b, c.CallTimeout); err != nil {
+		return nil, err
+	}
+	resp := new(RollbackResponse)
+	return resp, json.Unmarshal(b, resp)
+}
+
+// Encode and send a request, decoding the response into resp, if not nil
+func (c *Client) send(ctx context.Context, route string, req, resp interface{}, idempotent bool) error {
+	var body []byte
+	if req != nil {
+		var err error
+		if body, err = json.Marshal(req); err != nil {
+			return err
+		}
+	}
+	var b []byte
+	var err error
+	if idempotent {
+		b, err = c.retry(ctx, route, body)
+	} else {
+		b, err = c.post(ctx, route, body, c.Timeout)
+	}
+	if err != nil || resp == nil {
+		return err
+	}
+	return json.Unmarshal(b, resp)
+}
+
+// Post the body, retrying on connection errors and 5xx responses
+func (c *Client) retry(ctx context.Context, route string, body []byte) ([]byte, error) {
+	wait := c.Backoff
+	for i := 0; ; i++ {
+		b, err := c.post(ctx, route, body, c.Timeout)
+		if err == nil || i >= c.Retries || ctx.Err() != nil {
+			return b, err
+		}
+		if e, ok := err.(*APIError); ok && e.Status < 500 {
+			return b, err
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		wait *= 2
+	}
+}
+
+// Post the body to the route once
+func (c *Client) post(ctx context.Context, route string, body []byte, timeout time.Duration) ([]byte, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequest("POST", "http://"+c.Host+"/"+route, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	client := c.HTTP
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode > 399 {
+		e := &APIError{Route: route, Status: resp.StatusCode, Message: string(contents)}
+		var er ErrorResponse
+		if json.Unmarshal(contents, &er) == nil && er.Error != "" {
+			e.Message = er.Error
+		}
+		return nil, e
+	}
+	return contents, nil
+}
@@ -0,0 +1,160 @@
+package debora
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A daemon that answers each request with the next status,
+// and the last one once they run out
+type testDaemon struct {
+	mtx      sync.Mutex
+	statuses []int
+	body     string
+	times    []time.Time
+}
+
+func (d *testDaemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mtx.Lock()
+	i := len(d.times)
+	d.times = append(d.times, time.Now())
+	if i >= len(d.statuses) {
+		i = len(d.statuses) - 1
+	}
+	status := d.statuses[i]
+	d.mtx.Unlock()
+	if status != http.StatusOK {
+		writeError(w, status, errTestDaemon)
+		return
+	}
+	w.Write([]byte(d.body))
+}
+
+func (d *testDaemon) attempts() int {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return len(d.times)
+}
+
+var errTestDaemon = errors.New("test daemon error")
+
+func testClient(t *testing.T, d *testDaemon) *Client {
+	srv := httptest.NewServer(d)
+	t.Cleanup(srv.Close)
+	c := NewClient(strings.TrimPrefix(srv.URL, "http://"))
+	c.Backoff = 20 * time.Millisecond
+	return c
+}
+
+func TestClientRetriesServerErrors(t *testing.T) {
+	d := &testDaemon{statuses: []int{500, 503, 200}}
+	c := testClient(t, d)
+	if err := c.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := d.attempts(); n != 3 {
+		t.Fatalf("expected 3 attempts, got %d", n)
+	}
+	// the wait doubles after each attempt
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	for i, wait := range []time.Duration{c.Backoff, 2 * c.Backoff} {
+		if gap := d.times[i+1].Sub(d.times[i]); gap < wait {
+			t.Fatalf("retry %d came after %s, expected at least %s", i+1, gap, wait)
+		}
+	}
+}
+
+func TestClientGivesUp(t *testing.T) {
+	d := &testDaemon{statuses: []int{500}}
+	c := testClient(t, d)
+	err := c.Ping(context.Background())
+	if e, ok := err.(*APIError); !ok || e.Status != 500 || e.Message != errTestDaemon.Error() {
+		t.Fatalf("expected the daemon's error, got %v", err)
+	}
+	if n := d.attempts(); n != c.Retries+1 {
+		t.Fatalf("expected %d attempts, got %d", c.Retries+1, n)
+	}
+}
+
+func TestClientDoesntRetryClientErrors(t *testing.T) {
+	d := &testDaemon{statuses: []int{400, 200}}
+	c := testClient(t, d)
+	err := c.Ping(context.Background())
+	if e, ok := err.(*APIError); !ok || e.Status != 400 {
+		t.Fatalf("expected a 400 error, got %v", err)
+	}
+	if n := d.attempts(); n != 1 {
+		t.Fatalf("retried a 4xx response %d times", n-1)
+	}
+}
+
+// Routes that restart the app or change the daemon are sent once
+func TestClientDoesntRetryUnsafeRoutes(t *testing.T) {
+	ctx := context.Background()
+	for name, call := range map[string]func(c *Client) error{
+		"restart": func(c *Client) error { return c.Restart(ctx, RestartRequest{App: "app"}) },
+		"start":   func(c *Client) error { return c.Start(ctx, StartRequest{App: "app"}) },
+		"call":    func(c *Client) error { return c.Call(ctx, CallRequest{UpgradeMsg: testUpgradeMsg()}) },
+		"kill":    func(c *Client) error { return c.Kill(ctx) },
+		"rollback": func(c *Client) error {
+			_, err := c.Rollback(ctx, "")
+			return err
+		},
+	} {
+		d := &testDaemon{statuses: []int{500, 200}}
+		if err := call(testClient(t, d)); err == nil {
+			t.Fatalf("%s: expected the 500 error", name)
+		}
+		if n := d.attempts(); n != 1 {
+			t.Fatalf("%s was sent %d times", name, n)
+		}
+	}
+}
+
+func TestClientTimeouts(t *testing.T) {
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer srv.Close()
+	defer close(block)
+	c := NewClient(strings.TrimPrefix(srv.URL, "http://"))
+	c.Timeout = 50 * time.Millisecond
+	c.CallTimeout = 50 * time.Millisecond
+	c.Retries = 0
+
+	done := make(chan error, 2)
+	go func() { done <- c.Ping(context.Background()) }()
+	go func() { done <- c.Call(context.Background(), CallRequest{UpgradeMsg: testUpgradeMsg()}) }()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Fatal("expected a timeout")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("request didn't time out")
+		}
+	}
+}
+
+// Older daemons answer a known process with a plain "ok"
+func TestClientKnownOldDaemon(t *testing.T) {
+	c := testClient(t, &testDaemon{statuses: []int{200}, body: "ok"})
+	if known, err := c.Known(context.Background(), 1); err != nil || !known {
+		t.Fatalf("expected known, got %v %v", known, err)
+	}
+	for _, d := range []*testDaemon{{statuses: []int{404}}, {statuses: []int{200}, body: ""}} {
+		c = testClient(t, d)
+		if known, err := c.Known(context.Background(), 1); err != nil || known {
+			t.Fatalf("expected unknown for %d %q, got %v %v", d.statuses[0], d.body, known, err)
+		}
+	}
+}
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/codegangsta/cli"
 	"github.com/ebuchman/debora"
+	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"strconv"
+	"strings"
+	"text/tabwriter"
 	"time"
 )
 
@@ -39,6 +45,54 @@ func main() {
 				remoteHostFlag,
 				remotePortFlag,
 				commitFlag,
+				directiveFlag,
+				activateAtFlag,
+				activateHeightFlag,
+				maxDownFlag,
+				percentFlag,
+				includeFlag,
+				excludeFlag,
+				peersFlag,
+				timeoutFlag,
+				quietFlag,
+				maxFailuresFlag,
+				artifactFlag,
+				artifactURLFlag,
+				deltaURLFlag,
+				chunksFlag,
+				bundleFlag,
+				bundleURLFlag,
+				binaryHashFlag,
+				toolchainFlag,
+				binaryMsgFlag,
+				gossipTTLFlag,
+				tunnelFlag,
+			},
+		},
+		cli.Command{
+			Name:   "delta",
+			Usage:  "produce a patch from an old release binary to a new one: delta <old> <new> <patch>",
+			Action: cliDelta,
+			Flags:  []cli.Flag{},
+		},
+		cli.Command{
+			Name:   "status",
+			Usage:  "show the status of the debora daemon for an app, including pending upgrades",
+			Action: cliStatus,
+			Flags:  []cli.Flag{},
+		},
+		cli.Command{
+			Name:   "rollback",
+			Usage:  "switch an app back to a stored binary and restart it: rollback <app> [commit]",
+			Action: cliRollback,
+			Flags:  []cli.Flag{},
+		},
+		cli.Command{
+			Name:   "migrations",
+			Usage:  "list the data migrations that have run for an app: migrations <app> [dir]. with --dry-run, list the pending ones of the checkout at dir",
+			Action: cliMigrations,
+			Flags: []cli.Flag{
+				dryRunFlag,
 			},
 		},
 		cli.Command{
@@ -65,10 +119,9 @@ func cliKill(c *cli.Context) {
 		log.Fatal("Must specify application name")
 	}
 	app := args[0]
-	host, err := debora.ResolveHost(app)
-	ifExit(err)
-	_, err = debora.RequestResponse(host, "kill", nil)
+	client, err := debora.NewAppClient(app)
 	ifExit(err)
+	ifExit(client.Kill(context.Background()))
 }
 
 // run debora and block forever
@@ -91,9 +144,36 @@ func cliCall(c *cli.Context) {
 	listenHost := c.String("listen-host")
 	listenPort := c.Int("listen-port")
 	commit := c.String("commit")
+	activateAt := c.String("at")
+	activateHeight := c.Int("height")
+	maxDown := c.Int("max-down")
+	percent := c.Int("percent")
+	include := splitList(c.String("include"))
+	exclude := splitList(c.String("exclude"))
+	criteria := debora.CallCriteria{
+		Peers:   c.Int("peers"),
+		Timeout: time.Duration(c.Int("timeout")) * time.Second,
+		Quiet:   time.Duration(c.Int("quiet")) * time.Second,
+	}
+	maxFailures := c.Int("max-failures")
+	artifactFile := c.String("artifact")
+	artifactURLs := splitList(c.String("artifact-url"))
+	deltaURLs := splitList(c.String("delta-url"))
 
+	var directives []debora.Directive
+	for _, s := range c.StringSlice("directive") {
+		d, err := debora.ParseDirective(s)
+		ifExit(err)
+		directives = append(directives, d)
+	}
+	if len(directives) > 0 {
+		if commit != "" {
+			ifExit(fmt.Errorf("Use --directive upgrade-app=<commit> instead of --commit with other directives"))
+		}
+		commit = debora.DirectivesLabel(directives)
+	}
 	if commit == "" {
-		ifExit(fmt.Errorf("Commit hash must not be empty"))
+		ifExit(fmt.Errorf("Commit must not be empty"))
 	}
 
 	args := c.Args()
@@ -106,32 +186,247 @@ func cliCall(c *cli.Context) {
 		ifExit(fmt.Errorf("Unknown application %s", name))
 	}
 
+	// tunneled peers reach the call server through our own app
+	tunnel := c.Bool("tunnel")
+	if tunnel && listenHost == "0.0.0.0" {
+		listenHost = "localhost"
+	}
 	remote := remoteHost + ":" + strconv.Itoa(remotePort)
 	listen := listenHost + ":" + strconv.Itoa(listenPort)
 
 	// we want the clients to know our address (port, really)
-	reqObj := debora.RequestObj{
-		Host:   listen,
-		Commit: commit,
+	reqObj := debora.UpgradeMsg{
+		Version:        debora.ProtocolVersion,
+		Host:           listen,
+		Commit:         commit,
+		Directives:     directives,
+		ActivateHeight: int64(activateHeight),
+		MaxDown:        maxDown,
+		Percent:        percent,
+		Include:        include,
+		Exclude:        exclude,
+		BinarySHA256:   c.String("binary-hash"),
+		Toolchain:      c.String("toolchain"),
+		Tunnel:         tunnel,
+	}
+	if activateAt != "" {
+		t, err := time.Parse(time.RFC3339, activateAt)
+		ifExit(err)
+		reqObj.ActivateAt = t.UTC().Unix()
+	}
+	priv := app.PrivateKey
+	if artifactFile != "" {
+		if len(artifactURLs) == 0 && !c.Bool("chunks") {
+			ifExit(fmt.Errorf("Artifact urls must not be empty"))
+		}
+		// peers installing the artifact don't fetch, so they can't resolve a reference
+		if !debora.IsCommitHash(reqObj.Commit) {
+			ifExit(fmt.Errorf("An artifact must be built from a full commit hash, not %q. Try --commit $(git rev-parse %s)", reqObj.Commit, reqObj.Commit))
+		}
+		a, err := debora.NewArtifact(artifactFile, reqObj.Commit, priv, artifactURLs)
+		ifExit(err)
+		if c.Bool("chunks") {
+			a.Manifest, err = debora.NewManifest(artifactFile, priv)
+			ifExit(err)
+		}
+		for _, u := range deltaURLs {
+			d, err := debora.NewDelta(u)
+			ifExit(err)
+			a.Deltas = append(a.Deltas, *d)
+		}
+		reqObj.Artifact = a
+	}
+	if bundleFile := c.String("bundle"); bundleFile != "" {
+		bundle, err := debora.NewBundle(bundleFile, reqObj.Commit, priv, splitList(c.String("bundle-url")))
+		ifExit(err)
+		reqObj.Bundle = bundle
 	}
 	b, err := json.Marshal(reqObj)
 	ifExit(err)
+	if c.Bool("binary") {
+		b = debora.EncodeUpgrade(reqObj)
+	}
+	if ttl := c.Int("gossip-ttl"); ttl > 0 {
+		// relayed peers reach us at the message's host
+		if ip := net.ParseIP(listenHost); !tunnel && ip != nil && ip.IsUnspecified() {
+			ifExit(fmt.Errorf("Gossip needs a public --listen-host, not %s", listenHost))
+		}
+		b, err = debora.NewGossip(reqObj, priv, ttl)
+		ifExit(err)
+	}
 
-	priv := app.PrivateKey
+	dev := debora.NewDeveloperDebora(priv, maxDown)
 	// listen and serve for authentication requests from clients
 	go func() {
-		err = debora.DeveloperListenAndServe(listen, priv)
+		err := dev.ListenAndServe(listen)
 		ifExit(err)
 	}()
 
 	log.Println("Triggering broadcast with request to:", remote)
-	// trigger the broadcast with an http request
-	_, err = debora.RequestResponse(remote, "call", b)
+	// trigger the broadcast with an http request.
+	// the app may take a while to hand it to its peers
+	ctx, cancel := context.WithTimeout(context.Background(), debora.DefaultCallTimeout)
+	_, err = debora.RequestResponseContext(ctx, remote, "call", b)
+	cancel()
+	ifExit(err)
+
+	// show the peers' progress as they report it
+	go func() {
+		last := ""
+		for {
+			time.Sleep(time.Second)
+			table := reportTable(dev.Reports())
+			if table != last {
+				fmt.Print(table)
+				last = table
+			}
+		}
+	}()
+
+	// wait for the rollout to complete and summarize it
+	summary := dev.Wait(criteria)
+	fmt.Print(reportTable(summary.Reports))
+	fmt.Println("Rollout summary:")
+	fmt.Println("  Authenticated:", summary.Handshakes)
+	fmt.Println("  Succeeded:", summary.Succeeded)
+	fmt.Println("  Failed:", summary.Failed)
+	fmt.Println("  Skipped:", summary.Skipped)
+	fmt.Println("  Staged:", summary.Staged)
+	fmt.Println("  Unfinished:", summary.Unfinished)
+	if summary.TimedOut {
+		fmt.Println("  Timed out")
+	}
+	if maxFailures >= 0 && summary.Failures() > maxFailures {
+		log.Printf("%d peers failed to upgrade (max %d)\n", summary.Failures(), maxFailures)
+		os.Exit(1)
+	}
+}
+
+// format the peers' upgrade reports as a table
+func reportTable(reports []debora.Report) string {
+	buf := new(bytes.Buffer)
+	w := tabwriter.NewWriter(buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PEER\tCOMMIT\tSTAGE\tSTATUS\tTIME\tERROR")
+	for _, r := range reports {
+		status := "running"
+		switch {
+		case r.Failed():
+			status = "failed"
+		case r.Done:
+			status = "done"
+		}
+		var total int64
+		for _, ms := range r.Timings {
+			total += ms
+		}
+		elapsed := time.Duration(total) * time.Millisecond
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", r.PeerID, r.Commit, r.Stage, status, elapsed, r.Error)
+	}
+	w.Flush()
+	return buf.String()
+}
+
+// print the daemon's status
+func cliStatus(c *cli.Context) {
+	args := c.Args()
+	if len(args) == 0 {
+		log.Fatal("Must specify application name")
+	}
+	app := args[0]
+	client, err := debora.NewAppClient(app)
+	ifExit(err)
+	status, err := client.Status(context.Background())
+	ifExit(err)
+	fmt.Println("Peer ID:", status.PeerID)
+	fmt.Println("App:", status.App)
+	fmt.Println("Pid:", status.Pid)
+	if status.Commit != "" {
+		fmt.Println("Commit:", status.Commit)
+	}
+	if status.Height > 0 {
+		fmt.Println("Height:", status.Height)
+	}
+	if p := status.Pending; p != nil {
+		fmt.Println("Pending upgrade:", p.Commit)
+		if p.ActivateAt > 0 {
+			fmt.Println("  Activates at:", time.Unix(p.ActivateAt, 0).UTC().Format(time.RFC3339))
+		}
+		if p.ActivateHeight > 0 {
+			fmt.Println("  Activates at height:", p.ActivateHeight)
+		}
+	}
+	binaries, err := debora.StoredBinaries(app)
+	ifExit(err)
+	if len(binaries) > 0 {
+		cur, _ := os.Readlink(debora.BinaryLink(app))
+		fmt.Println("Stored binaries:")
+		for _, b := range binaries {
+			mark := " "
+			if b.Path == cur {
+				mark = "*"
+			}
+			fmt.Printf("%s %s  %s  %s\n", mark, b.Commit, b.Name, time.Unix(b.Installed, 0).UTC().Format(time.RFC3339))
+		}
+	}
+}
+
+// roll the app back to a stored binary
+func cliRollback(c *cli.Context) {
+	args := c.Args()
+	if len(args) == 0 {
+		log.Fatal("Must specify application name")
+	}
+	app := args[0]
+	var commit string
+	if len(args) > 1 {
+		commit = args[1]
+	}
+	client, err := debora.NewAppClient(app)
+	ifExit(err)
+	resp, err := client.Rollback(context.Background(), commit)
+	ifExit(err)
+	fmt.Println("Rolled back to", resp.Commit)
+}
+
+func cliMigrations(c *cli.Context) {
+	args := c.Args()
+	if len(args) == 0 {
+		log.Fatal("Must specify application name")
+	}
+	app := args[0]
+	if c.Bool("dry-run") {
+		dir, err := os.Getwd()
+		ifExit(err)
+		if len(args) > 1 {
+			dir = args[1]
+		}
+		ifExit(debora.DryRunMigrations(app, dir, os.Stdout))
+		return
+	}
+	applied, err := debora.AppliedMigrations(app)
 	ifExit(err)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCOMMIT\tRAN AT")
+	for _, m := range applied {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", m.ID, m.Commit, time.Unix(m.At, 0).UTC().Format(time.RFC3339))
+	}
+	w.Flush()
+}
 
-	for {
-		time.Sleep(time.Second)
+// write a patch from an old binary to a new one
+func cliDelta(c *cli.Context) {
+	args := c.Args()
+	if len(args) < 3 {
+		log.Fatal("Usage: debora delta <old binary> <new binary> <patch file>")
 	}
+	old, err := ioutil.ReadFile(args[0])
+	ifExit(err)
+	next, err := ioutil.ReadFile(args[1])
+	ifExit(err)
+	patch, err := debora.Diff(old, next)
+	ifExit(err)
+	ifExit(ioutil.WriteFile(args[2], patch, 0644))
+	fmt.Printf("Wrote %s (%d bytes, %d for the full binary)\n", args[2], len(patch), len(next))
 }
 
 func cliKeygen(c *cli.Context) {
@@ -176,10 +471,154 @@ var (
 	commitFlag = cli.StringFlag{
 		Name:  "commit",
 		Value: "",
-		Usage: "commit hash to checkout",
+		Usage: "commit hash, tag, branch or version constraint (eg. \"^1.4\") to checkout",
+	}
+
+	directiveFlag = cli.StringSliceFlag{
+		Name:  "directive",
+		Value: &cli.StringSlice{},
+		Usage: "upgrade step, run in order (repeatable): upgrade-app=<commit>, upgrade-debora=<commit>, migrate=<command>, set-args=<args> or restart",
+	}
+
+	activateAtFlag = cli.StringFlag{
+		Name:  "at",
+		Value: "",
+		Usage: "UTC time (RFC3339) at which peers activate the upgrade",
+	}
+
+	activateHeightFlag = cli.IntFlag{
+		Name:  "height",
+		Value: 0,
+		Usage: "app height at which peers activate the upgrade",
+	}
+
+	maxDownFlag = cli.IntFlag{
+		Name:  "max-down",
+		Value: 0,
+		Usage: "max number of peers restarting at once (0 for no limit)",
+	}
+
+	percentFlag = cli.IntFlag{
+		Name:  "percent",
+		Value: 0,
+		Usage: "percent of peers to upgrade, picked deterministically (0 for all, or only the included peers)",
+	}
+
+	includeFlag = cli.StringFlag{
+		Name:  "include",
+		Value: "",
+		Usage: "comma separated peer ids that always upgrade",
+	}
+
+	excludeFlag = cli.StringFlag{
+		Name:  "exclude",
+		Value: "",
+		Usage: "comma separated peer ids that never upgrade",
+	}
+
+	peersFlag = cli.IntFlag{
+		Name:  "peers",
+		Value: 0,
+		Usage: "stop once this many peers have reported being done or staged, and no other peer is still upgrading",
+	}
+
+	timeoutFlag = cli.IntFlag{
+		Name:  "timeout",
+		Value: 0,
+		Usage: "stop after this many seconds",
+	}
+
+	quietFlag = cli.IntFlag{
+		Name:  "quiet",
+		Value: 0,
+		Usage: "stop once no handshakes or reports arrive for this many seconds",
+	}
+
+	maxFailuresFlag = cli.IntFlag{
+		Name:  "max-failures",
+		Value: 0,
+		Usage: "exit with an error if more peers than this fail or are unfinished (-1 to never)",
+	}
+
+	artifactFlag = cli.StringFlag{
+		Name:  "artifact",
+		Value: "",
+		Usage: "prebuilt binary for peers to install instead of building from source",
+	}
+
+	artifactURLFlag = cli.StringFlag{
+		Name:  "artifact-url",
+		Value: "",
+		Usage: "comma separated urls (http, https or file) where peers can download the artifact",
+	}
+
+	deltaURLFlag = cli.StringFlag{
+		Name:  "delta-url",
+		Value: "",
+		Usage: "comma separated urls of patches to the artifact from previous releases (see `debora delta`)",
+	}
+
+	dryRunFlag = cli.BoolFlag{
+		Name:  "dry-run",
+		Usage: "list the pending migrations without running them",
+	}
+
+	chunksFlag = cli.BoolFlag{
+		Name:  "chunks",
+		Usage: "let peers fetch the artifact in chunks from each other, over the app's p2p layer",
+	}
+
+	binaryMsgFlag = cli.BoolFlag{
+		Name:  "binary",
+		Usage: "broadcast the upgrade message in the compact binary encoding instead of json",
+	}
+
+	tunnelFlag = cli.BoolFlag{
+		Name:  "tunnel",
+		Usage: "have peers reach us through the app's p2p layer, so the listen port needn't be exposed. listens on localhost by default",
+	}
+
+	gossipTTLFlag = cli.IntFlag{
+		Name:  "gossip-ttl",
+		Usage: "sign the upgrade message and have peers relay it to their neighbors, for this many hops. needs a public --listen-host",
+	}
+
+	bundleFlag = cli.StringFlag{
+		Name:  "bundle",
+		Value: "",
+		Usage: "git bundle with the new commits, for peers that can't reach origin (see `git bundle create`)",
+	}
+
+	bundleURLFlag = cli.StringFlag{
+		Name:  "bundle-url",
+		Value: "",
+		Usage: "comma separated urls where peers can get the bundle. without them it's attached to the upgrade message",
+	}
+
+	binaryHashFlag = cli.StringFlag{
+		Name:  "binary-hash",
+		Value: "",
+		Usage: "sha256 of the binary built reproducibly from the commit. peers refuse binaries that differ",
+	}
+
+	toolchainFlag = cli.StringFlag{
+		Name:  "toolchain",
+		Value: "",
+		Usage: "go toolchain peers build with, eg. go1.22.3",
 	}
 )
 
+// split a comma separated list, dropping empty entries
+func splitList(s string) []string {
+	var list []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
 func ifExit(err error) {
 	if err != nil {
 		log.Fatal(err)
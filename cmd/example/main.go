@@ -2,6 +2,7 @@ package main
 
 import (
 	//	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
 	"github.com/ebuchman/debora"
@@ -153,13 +154,16 @@ func (a *App) broadcast(payload []byte) {
 	fmt.Println("Broadcast!")
 	// broadcast MsgDeboraTy message with payload to all peers
 	for conAddr, listenAddr := range peers {
-		/*reqObj := debora.RequestObj{
+		/*reqObj := debora.UpgradeMsg{
 			Host: bootstrap,
 		}*/
 		//b, _ := json.Marshal(reqObj)
 		fmt.Printf("attempting broadcast to %s at %s\n", conAddr, listenAddr)
 		// send MsgDeboraTy
-		b, err := debora.RequestResponse(listenAddr, "debora", payload)
+		// the peer answers once its upgrade is scheduled
+		ctx, cancel := context.WithTimeout(context.Background(), debora.DefaultCallTimeout)
+		b, err := debora.RequestResponseContext(ctx, listenAddr, "debora", payload)
+		cancel()
 		if err != nil {
 			fmt.Println(err)
 		}
@@ -1,6 +1,7 @@
 package debora
 
 import (
+	"crypto"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
@@ -109,3 +110,21 @@ func CheckMAC(message, messageMAC, key []byte) bool {
 	expectedMAC := mac.Sum(nil)
 	return hmac.Equal(messageMAC, expectedMAC)
 }
+
+// Takes hex encoded DER private key and signs the sha256 digest of a message
+func Sign(privHex string, digest []byte) ([]byte, error) {
+	priv, err := DecodePrivateKey(privHex)
+	if err != nil {
+		return nil, err
+	}
+	return rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, digest)
+}
+
+// Takes hex encoded DER public key and checks the signature of a sha256 digest
+func Verify(pubHex string, digest, sig []byte) error {
+	pub, err := DecodePublicKey(pubHex)
+	if err != nil {
+		return err
+	}
+	return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, sig)
+}
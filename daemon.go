@@ -1,8 +1,9 @@
 package debora
 
 import (
+	"context"
 	"crypto/rand"
-	"encoding/json"
+	"encoding/hex"
 	"os"
 	"os/exec"
 	"path"
@@ -13,21 +14,15 @@ import (
 	Client side functions for sending requests to the local daemon
 */
 
-// check if the debora server is running
-func rpcIsDeboraRunning(host string) bool {
-	_, err := RequestResponse(host, "ping", nil)
-	if err != nil {
-		logger.Println(err)
-		return false
-	}
-	return true
-}
-
 // start the debrora server
 // install if not present
 // block until she starts
-// spawn the app
-func startDebora(app string, args []string, appPid int) error {
+// spawn the app.
+// obj is the app's info for the new debora
+func startDebora(obj RestartRequest, appPid int) error {
+	app, args := obj.App, obj.Args
+	ctx := context.Background()
+
 	// if debora is not installed, install her
 	if _, err := os.Stat(DeboraBin); err != nil {
 		if err := installDebora(); err != nil {
@@ -80,13 +75,15 @@ func startDebora(app string, args []string, appPid int) error {
 			continue
 		}
 
-		// the new debora should be up, this is its address
-		host := "localhost:" + b
-		if rpcIsDeboraRunning(host) {
+		// the new debora should be up, this is its address.
+		// we're polling, so don't retry
+		c := NewClient("localhost:" + b)
+		c.Retries = 0
+		if err := c.Ping(ctx); err == nil {
 			if appPid < 0 {
 				// if the app is being started for the first time,
 				// have the new debora process start it
-				if err := rpcStartApp(host, app, args); err != nil {
+				if err := c.Start(ctx, StartRequest{App: app, Args: args}); err != nil {
 					return err
 				}
 				break
@@ -94,7 +91,8 @@ func startDebora(app string, args []string, appPid int) error {
 				// the app is being restarted, so tell the new debora process
 				// to kill and then restart it,
 				// and make sure it reports back to us so we can die in peace
-				if err := rpcRestartApp(host, app, args, appPid); err != nil {
+				obj.Pid = appPid
+				if err := c.Restart(ctx, obj); err != nil {
 					return err
 				}
 				break
@@ -104,107 +102,35 @@ func startDebora(app string, args []string, appPid int) error {
 	return nil
 }
 
-// install the debora binary (server)
+// install the debora binary (server).
+// Use the local checkout if there is one,
+// otherwise install the version this app was built with
 func installDebora() error {
 	logger.Println("Installing debora ...")
-	cur, _ := os.Getwd()
-	if err := os.Chdir(DeboraCmdPath); err != nil {
-		return err
-	}
-	/*cmd := exec.Command("go", "get", "-d")
-	if err := cmd.Run(); err != nil {
-		return err
-	}*/
-	cmd := exec.Command("go", "install", "-v")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		return err
-	}
-	os.Chdir(cur)
-	return nil
-}
-
-// tell debora to start a new instance of us to be the app process
-func rpcStartApp(host, app string, args []string) error {
-	reqObj := RequestObj{
-		Args: args,
-		App:  app,
-	}
-	b, err := json.Marshal(reqObj)
-	if err != nil {
-		return err
-	}
-	_, err = RequestResponse(host, "start", b)
-	return err
-}
-
-// tell debora to terminate and restart the app process
-func rpcRestartApp(host, app string, args []string, appPid int) error {
-	reqObj := RequestObj{
-		Args: args,
-		App:  app,
-		Pid:  appPid,
+	if _, err := os.Stat(DeboraCmdPath); err == nil {
+		return goInstall(DeboraCmdPath, ".", "", os.Stdout, nil)
 	}
-	b, err := json.Marshal(reqObj)
-	if err != nil {
-		return err
-	}
-	_, err = RequestResponse(host, "restart", b)
-	return err
+	cur, _ := os.Getwd()
+	return goInstall(cur, DeboraPkg+"@"+deboraVersion(), "", os.Stdout, nil)
 }
 
 // add a process to debora
-func rpcAdd(host, key, name, src, logfile string, pid int, args []string) error {
-	reqObj := RequestObj{
+func addRequest(key, name, src, logfile string, pid int, args []string) AddRequest {
+	return AddRequest{
 		Key:     key,
 		Pid:     pid,
 		Args:    args,
 		App:     name,
 		Src:     src,
-		Host:    host,
 		LogFile: logfile,
-	}
-	b, err := json.Marshal(reqObj)
-	if err != nil {
-		return err
-	}
-	_, err = RequestResponse(host, "add", b)
-	return err
-}
-
-// initiate the debora call
-func rpcCall(host, remote, commit string, pid int) error {
-	reqObj := RequestObj{
-		Pid:    pid,
-		Host:   remote,
-		Commit: commit,
-	}
-	b, err := json.Marshal(reqObj)
-	if err != nil {
-		return err
-	}
-	_, err = RequestResponse(host, "call", b)
-	return err
-}
+		Hooks:   hookCmds,
+		Pkg:     installPkg,
+		Build:   buildSpec,
 
-// check if the process is known to debora
-func rpcKnownDeb(host string, pid int) bool {
-	reqObj := RequestObj{Pid: pid}
-	b, err := json.Marshal(reqObj)
-	if err != nil {
-		logger.Println(err)
-		return false
+		HookFuncs:   hookFuncStages(),
+		DirtyPolicy: dirtyPolicy,
+		GoProxy:     goProxy,
 	}
-	b, err = RequestResponse(host, "known", b)
-	if err != nil {
-		logger.Println(err)
-		return false
-	}
-	if b == nil || len(b) == 0 {
-		return false
-	}
-	return true
 }
 
 /*
@@ -212,30 +138,40 @@ func rpcKnownDeb(host string, pid int) bool {
 */
 
 // create random nonce, encrypt with public key
-// send to developer, validate hmac response
-func handshake(key, host string) (bool, error) {
+// send to developer, validate hmac response.
+// Returns the token for the developer's other routes,
+// or the empty string if the developer is not who she claims
+func handshake(key string, dev devConn) (string, error) {
 	// generate nonce
 	nonce := make([]byte, 32)
 	_, err := rand.Read(nonce)
 	if err != nil {
-		return false, err
+		return "", err
 	}
 
 	// encrypt nonce with developers public key
 	cipherText, err := Encrypt(key, nonce)
 	if err != nil {
-		return false, err
+		return "", err
 	}
 
 	// send encrypted nonce to developer
-	logger.Println("sending nonce to dev:", host)
-	response, err := RequestResponse(host, "handshake", cipherText)
+	logger.Println("sending nonce to dev:", dev.host)
+	response, err := dev.request("handshake", cipherText)
 	if err != nil {
-		return false, err
+		return "", err
 	}
 
 	// the mac is simply done on the nonce itself
 	// using the nonce as key and message
-	ok := CheckMAC(nonce, response, nonce)
-	return ok, nil
+	if !CheckMAC(nonce, response, nonce) {
+		return "", nil
+	}
+	return handshakeToken(nonce), nil
+}
+
+// The token authorizing a peer's later requests to the developer.
+// Only the peer and the developer know the nonce it is derived from
+func handshakeToken(nonce []byte) string {
+	return hex.EncodeToString(SignMAC([]byte("debora token"), nonce))
 }
@@ -1,7 +1,7 @@
 package debora
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"net"
 	"net/http"
@@ -13,16 +13,18 @@ import (
 var (
 	// important paths
 	HomeDir       = homeDir()
-	GoPath        = os.Getenv("GOPATH")
+	GoPath        = goPath()
 	GoSrc         = path.Join(GoPath, "src")
 	DeboraRoot    = path.Join(HomeDir, ".debora")
 	DeboraApps    = path.Join(DeboraRoot, "apps")
 	DeboraConfig  = path.Join(DeboraRoot, "config.json")
-	DeboraBin     = path.Join(GoPath, "bin", "debora")
-	DeboraSrcPath = path.Join(GoPath, "src", "github.com", "ebuchman", "debora")
+	GoBin         = goBin()
+	DeboraBin     = path.Join(GoBin, "debora")
+	DeboraSrcPath = deboraSrcPath()
 	DeboraCmdPath = path.Join(DeboraSrcPath, "cmd", "debora")
 
 	deboraHost string // host debora for this app process
+	deboraKey  string // developer's public key, given to Add
 )
 
 // Debra interface from caller is two functions:
@@ -34,9 +36,17 @@ var (
 // Add the current process to debora's control table
 // If the process was started by the user, no debora exists.
 //  	Start one, and have it launch the app proper
-// The calling app provides dev's public key, path to src, app name, and a directory for debora logs
+// The calling app provides dev's public key, path to src, app name, and a directory for debora logs.
+// src is either relative to $GOPATH/src or an absolute path, eg. to a module mode checkout
 // This function should be called as early as possible in the program
 func Add(key, src, app, logfile string) error {
+	return AddWithHeight(key, src, app, logfile, nil)
+}
+
+// Like Add, but the app also reports its height to debora
+// through the height callback, so upgrades can be
+// scheduled to activate at a given height
+func AddWithHeight(key, src, app, logfile string, height func() int64) error {
 	host, err := ResolveHost(app)
 	if err != nil {
 		return err
@@ -49,7 +59,7 @@ func Add(key, src, app, logfile string) error {
 	// start her and block forever.
 	// debora will start a new instance of the app that doesn't block
 	if host == "" {
-		if err := startDebora(app, ARGS, -1); err != nil {
+		if err := startDebora(RestartRequest{App: app, Args: ARGS}, -1); err != nil {
 			return err
 		}
 		logger.Println("We started deb and she's running. Block forever")
@@ -59,50 +69,69 @@ func Add(key, src, app, logfile string) error {
 
 	// if debora's not running,
 	// a mistake was made, so cleanup and try again
-	if !rpcIsDeboraRunning(host) {
+	ctx := context.Background()
+	c := NewClient(host)
+	if err := c.Ping(ctx); err != nil {
+		logger.Println(err)
 		logger.Printf("Found bad host, cleaning file. %s: %s\n", app, host)
 		if err := CleanHosts(app); err != nil {
 			return err
 		}
-		return Add(key, src, app, logfile)
+		return AddWithHeight(key, src, app, logfile, height)
 	}
 
 	// set the global host variable for this process
 	// so we can get it easily in Call
 	deboraHost = host
+	deboraKey = key
 
 	pid := os.Getpid()
-	if rpcKnownDeb(host, pid) {
+	known, err := c.Known(ctx, pid)
+	if err != nil {
+		return err
+	}
+	if known {
 		return fmt.Errorf("The process has already been added to debora")
 	}
 
 	logger.Printf("The developers public key is %s", key)
 
-	if err := rpcAdd(host, key, app, src, logfile, pid, ARGS); err != nil {
+	if err := c.Add(ctx, addRequest(key, app, src, logfile, pid, ARGS)); err != nil {
 		return err
 	}
 
+	if height != nil {
+		go reportHeight(host, pid, height)
+	}
+	if tunnelSend != nil {
+		go pollTunnel(c, pid)
+	}
+	if len(hookFuncs) > 0 {
+		go pollHooks(c, pid)
+	}
+
 	return nil
 }
 
 // Initiate sequence to upgrade and restart the current process
-// Payload is json encoded ReqObj with Host field, which gives us the host's port
+// Payload is the UpgradeMsg, json or binary encoded, with Host field, which gives us the host's port
 // but we need to use the knowledge of the p2p layer to get its ip address
-// Call this function when the 'signal' is received from trusted developer
+// Call this function when the 'signal' is received from trusted developer.
+// Gossip envelopes are verified and relayed, and reach the developer at Host itself.
+// Tunneled upgrades reach the developer through remoteHost, over the app's p2p layer
 func Call(remoteHost string, payload []byte) error {
-	localHost := deboraHost
-	if !rpcIsDeboraRunning(localHost) {
-		return fmt.Errorf("Debora is not running on this machine")
-	}
-	pid := os.Getpid()
-	if !rpcKnownDeb(localHost, pid) {
-		return fmt.Errorf("This process is not known to debora. Did you run Add first?")
+	if isGossip(payload) {
+		return handleGossip(remoteHost, payload)
 	}
 
-	var reqObj = RequestObj{}
-	if err := json.Unmarshal(payload, &reqObj); err != nil {
+	reqObj, err := decodeUpgrade(payload)
+	if err != nil {
 		return err
 	}
+	// tunneled requests go back to the peer, so there's no address to fix up
+	if reqObj.Tunnel {
+		return callDebora(reqObj, reqObj.Host, &TunnelRoute{Peer: remoteHost})
+	}
 
 	// get port from address provided by developer
 	_, port, err := net.SplitHostPort(reqObj.Host)
@@ -111,10 +140,43 @@ func Call(remoteHost string, payload []byte) error {
 	}
 	// get ip from address provided by caller
 	ip, _, err := net.SplitHostPort(remoteHost)
+	if err != nil {
+		return err
+	}
 
 	remoteHost = net.JoinHostPort(ip, port)
+	return callDebora(reqObj, remoteHost, nil)
+}
 
-	return rpcCall(localHost, remoteHost, reqObj.Commit, pid)
+// Hand the upgrade message to our debora,
+// who reaches the developer at host, or through the route if the upgrade is tunneled
+func callDebora(reqObj UpgradeMsg, host string, route *TunnelRoute) error {
+	if reqObj.Tunnel && tunnelSend == nil {
+		return fmt.Errorf("The upgrade is tunneled, but there is no tunnel sender. Call SetTunnelSender before Add")
+	}
+	ctx := context.Background()
+	c := NewClient(deboraHost)
+	if err := c.Ping(ctx); err != nil {
+		return fmt.Errorf("Debora is not running on this machine: %s", err.Error())
+	}
+	pid := os.Getpid()
+	if known, err := c.Known(ctx, pid); err != nil {
+		return err
+	} else if !known {
+		return fmt.Errorf("This process is not known to debora. Did you run Add first?")
+	}
+
+	// fetch the artifact's chunks from peers while debora waits for them
+	if a := reqObj.Artifact; a != nil && a.Manifest != nil {
+		if err := a.Manifest.verify(deboraKey); err != nil {
+			logger.Println("Ignoring artifact manifest:", err)
+		} else {
+			go fetchChunks(a.Manifest)
+		}
+	}
+
+	reqObj.Host = host
+	return c.Call(ctx, CallRequest{UpgradeMsg: reqObj, Pid: pid, Route: route})
 }
 
 /*
@@ -145,6 +207,11 @@ func DeboraListenAndServe(app string) error {
 	mux.HandleFunc("/add", deb.add)
 	mux.HandleFunc("/call", deb.call)
 	mux.HandleFunc("/known", deb.known)
+	mux.HandleFunc("/height", deb.heightReport)
+	mux.HandleFunc("/status", deb.status)
+	mux.HandleFunc("/rollback", deb.rollback)
+	mux.HandleFunc("/tunnel", deb.tunnel)
+	mux.HandleFunc("/hook", deb.hook)
 
 	// let the OS choose a port for us
 	ln, err := net.Listen("tcp", "localhost:0")
@@ -186,12 +253,28 @@ func DebListenAndServe(appName string, port int, callFunc func(payload []byte))
 // authentication requests from clients
 // Started by `debora call`.
 func DeveloperListenAndServe(host, priv string) error {
-	deb := DeveloperDebora{
-		priv: priv,
+	return NewDeveloperDebora(priv, 0).ListenAndServe(host)
+}
+
+// Create the developer's call server.
+// If maxDown is positive, at most maxDown peers may restart at once
+func NewDeveloperDebora(priv string, maxDown int) *DeveloperDebora {
+	return &DeveloperDebora{
+		priv:    priv,
+		leases:  newLeaseTable(maxDown),
+		tokens:  make(map[string]string),
+		reports: make(map[string]Report),
 	}
+}
 
+// Serve authentication, restart lease and report requests from clients.
+// This function blocks
+func (deb *DeveloperDebora) ListenAndServe(host string) error {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/handshake", deb.handshake)
+	mux.HandleFunc("/lease", deb.lease)
+	mux.HandleFunc("/release", deb.release)
+	mux.HandleFunc("/report", deb.reportHandler)
 	logger.Println("Developer debora listening on", host)
 	if err := http.ListenAndServe(host, mux); err != nil {
 		return err
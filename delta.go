@@ -0,0 +1,307 @@
+package debora
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+/*
+	Binary delta patches for artifacts.
+	A delta turns a known previous binary into the new one, so
+	bandwidth constrained peers needn't download the full artifact.
+	The patch is a gzipped list of copy (from the old binary)
+	and insert (new bytes) ops, found by matching blocks of the
+	old binary with a rolling hash, in the style of rsync.
+	The result is checked against the artifact's signed hash and size,
+	and never grows past the size, so a bad patch can at worst
+	fall back to the full artifact.
+*/
+
+// A patch from a previous binary to an artifact
+type Delta struct {
+	From string // hex encoded sha256 of the binary the patch applies to
+	URL  string // where to download the patch
+}
+
+const (
+	deltaMagic     = "DBDELTA1"
+	deltaBlockSize = 32
+	deltaPrime     = 16777619
+
+	deltaOpEnd    = 0
+	deltaOpCopy   = 1
+	deltaOpInsert = 2
+)
+
+// rolling hash of a block
+func blockHash(b []byte) uint32 {
+	var h uint32
+	for _, c := range b {
+		h = h*deltaPrime + uint32(c)
+	}
+	return h
+}
+
+// Compute the patch turning old into next
+func Diff(old, next []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	w := bufio.NewWriter(zw)
+
+	oldSum := sha256.Sum256(old)
+	newSum := sha256.Sum256(next)
+	w.WriteString(deltaMagic)
+	w.Write(oldSum[:])
+	w.Write(newSum[:])
+	writeUvarint(w, uint64(len(next)))
+
+	// index the old binary's blocks
+	index := make(map[uint32]int)
+	for off := 0; off+deltaBlockSize <= len(old); off += deltaBlockSize {
+		h := blockHash(old[off : off+deltaBlockSize])
+		if _, ok := index[h]; !ok {
+			index[h] = off
+		}
+	}
+
+	// factor to roll the oldest byte out of the hash
+	var out uint32 = 1
+	for i := 0; i < deltaBlockSize-1; i++ {
+		out *= deltaPrime
+	}
+
+	// scan the new binary for matching blocks
+	lit := 0 // start of the bytes not yet written
+	i := 0
+	var h uint32
+	if len(next) >= deltaBlockSize {
+		h = blockHash(next[:deltaBlockSize])
+	}
+	for i+deltaBlockSize <= len(next) {
+		off, ok := index[h]
+		if ok && bytes.Equal(old[off:off+deltaBlockSize], next[i:i+deltaBlockSize]) {
+			// extend the match forwards and backwards
+			n := deltaBlockSize
+			for off+n < len(old) && i+n < len(next) && old[off+n] == next[i+n] {
+				n++
+			}
+			k := 0
+			for k < i-lit && off-k > 0 && old[off-k-1] == next[i-k-1] {
+				k++
+			}
+			writeInsert(w, next[lit:i-k])
+			writeCopy(w, off-k, n+k)
+			i += n
+			lit = i
+			if i+deltaBlockSize <= len(next) {
+				h = blockHash(next[i : i+deltaBlockSize])
+			}
+			continue
+		}
+		if i+deltaBlockSize < len(next) {
+			h = (h-uint32(next[i])*out)*deltaPrime + uint32(next[i+deltaBlockSize])
+		}
+		i++
+	}
+	writeInsert(w, next[lit:])
+	w.WriteByte(deltaOpEnd)
+
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeUvarint(w *bufio.Writer, x uint64) {
+	b := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(b, x)
+	w.Write(b[:n])
+}
+
+func writeInsert(w *bufio.Writer, b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	w.WriteByte(deltaOpInsert)
+	writeUvarint(w, uint64(len(b)))
+	w.Write(b)
+}
+
+func writeCopy(w *bufio.Writer, off, n int) {
+	w.WriteByte(deltaOpCopy)
+	writeUvarint(w, uint64(off))
+	writeUvarint(w, uint64(n))
+}
+
+// Read the hashes of the old and new binaries from a patch
+func deltaHeader(r *bufio.Reader) (oldSum, newSum []byte, err error) {
+	hdr := make([]byte, len(deltaMagic)+2*sha256.Size)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, nil, err
+	}
+	if string(hdr[:len(deltaMagic)]) != deltaMagic {
+		return nil, nil, fmt.Errorf("Not a debora delta")
+	}
+	hdr = hdr[len(deltaMagic):]
+	return hdr[:sha256.Size], hdr[sha256.Size:], nil
+}
+
+// Apply the patch to old, checking the hashes of the old and new binaries.
+// size is the size of the new binary, eg. from the signed artifact,
+// and bounds what the patch may produce
+func Patch(old, patch []byte, size int64) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(patch))
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(zr)
+	oldSum, newSum, err := deltaHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if sum := sha256.Sum256(old); !bytes.Equal(sum[:], oldSum) {
+		return nil, fmt.Errorf("Delta does not apply to this binary")
+	}
+	want, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 || want != uint64(size) {
+		return nil, fmt.Errorf("Delta size %d, expected %d", want, size)
+	}
+	out := make([]byte, 0, size)
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case deltaOpEnd:
+			if sum := sha256.Sum256(out); !bytes.Equal(sum[:], newSum) {
+				return nil, fmt.Errorf("Patched binary hash mismatch")
+			}
+			return out, nil
+		case deltaOpCopy:
+			off, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, err
+			}
+			n, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, err
+			}
+			if off > uint64(len(old)) || n > uint64(len(old))-off || n > uint64(size)-uint64(len(out)) {
+				return nil, fmt.Errorf("Delta copy out of range")
+			}
+			out = append(out, old[off:off+n]...)
+		case deltaOpInsert:
+			n, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, err
+			}
+			if n > uint64(size)-uint64(len(out)) {
+				return nil, fmt.Errorf("Delta insert out of range")
+			}
+			b := make([]byte, n)
+			if _, err := io.ReadFull(r, b); err != nil {
+				return nil, err
+			}
+			out = append(out, b...)
+		default:
+			return nil, fmt.Errorf("Unknown delta op %d", op)
+		}
+		if int64(len(out)) > size {
+			return nil, fmt.Errorf("Delta output exceeds its size")
+		}
+	}
+}
+
+// Create a delta for the patch at url (http, https or file).
+// Run by the developer
+func NewDelta(rawurl string) (*Delta, error) {
+	r, err := openURL(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	oldSum, _, err := deltaHeader(bufio.NewReader(zr))
+	if err != nil {
+		return nil, err
+	}
+	return &Delta{
+		From: hex.EncodeToString(oldSum),
+		URL:  rawurl,
+	}, nil
+}
+
+// Try to install the artifact into dir by patching the binary already there.
+// The patched binary must match the artifact's hash
+func (deb *Debora) installDelta(a *Artifact, dir string) error {
+	if a.Size <= 0 {
+		return fmt.Errorf("Artifact has no size to bound the patch")
+	}
+	cur := path.Join(GoBin, a.Name)
+	old, err := ioutil.ReadFile(cur)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(old)
+	from := hex.EncodeToString(sum[:])
+	for _, d := range a.Deltas {
+		if d.From != from {
+			continue
+		}
+		r, err := openURL(d.URL)
+		if err != nil {
+			return err
+		}
+		patch, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+		bin, err := Patch(old, patch, a.Size)
+		if err != nil {
+			return err
+		}
+		newSum := sha256.Sum256(bin)
+		if hex.EncodeToString(newSum[:]) != a.SHA256 {
+			return fmt.Errorf("Patched binary does not match the artifact hash")
+		}
+		f, err := ioutil.TempFile(dir, "."+a.Name)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(bin)
+		f.Close()
+		if err == nil {
+			err = os.Chmod(f.Name(), 0755)
+		}
+		if err == nil {
+			err = os.Rename(f.Name(), path.Join(dir, a.Name))
+		}
+		if err != nil {
+			os.Remove(f.Name())
+			return err
+		}
+		deb.Logf(fmt.Sprintf("Patched %s from %s to %s\n", a.Name, from, a.SHA256))
+		return nil
+	}
+	return fmt.Errorf("No delta from %s", from)
+}
@@ -0,0 +1,83 @@
+package debora
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func randomBytes(r *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	r.Read(b)
+	return b
+}
+
+func TestDiffPatchRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	old := randomBytes(r, 64*1024)
+
+	edited := append([]byte{}, old...)
+	copy(edited[1000:], randomBytes(r, 100))
+	edited = append(edited[:5000], append(randomBytes(r, 333), edited[5000:]...)...)
+	edited = append(edited[:20000], edited[21000:]...)
+
+	cases := map[string][]byte{
+		"same":      old,
+		"edited":    edited,
+		"appended":  append(append([]byte{}, old...), randomBytes(r, 1000)...),
+		"prefix":    old[:len(old)/2],
+		"unrelated": randomBytes(r, 10000),
+		"empty":     nil,
+		"tiny":      []byte("x"),
+	}
+	for name, next := range cases {
+		patch, err := Diff(old, next)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got, err := Patch(old, patch, int64(len(next)))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(got, next) {
+			t.Fatalf("%s: patched binary differs", name)
+		}
+	}
+
+	// mostly copies from the old binary
+	patch, _ := Diff(old, edited)
+	if len(patch) > len(edited)/10 {
+		t.Fatalf("patch of a small edit is %d bytes", len(patch))
+	}
+}
+
+func TestPatchRejects(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	old := randomBytes(r, 8*1024)
+	next := append(append([]byte{}, old[:4000]...), randomBytes(r, 2000)...)
+	patch, err := Diff(old, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the signed size must match the patch
+	for _, size := range []int64{0, int64(len(next)) - 1, int64(len(next)) + 1, 1 << 40, -1} {
+		if _, err := Patch(old, patch, size); err == nil {
+			t.Fatalf("patch applied with size %d", size)
+		}
+	}
+	// to another binary
+	other := append([]byte{}, old...)
+	other[0]++
+	if _, err := Patch(other, patch, int64(len(next))); err == nil {
+		t.Fatal("patch applied to another binary")
+	}
+	// truncated
+	if _, err := Patch(old, patch[:len(patch)/2], int64(len(next))); err == nil {
+		t.Fatal("truncated patch applied")
+	}
+	// not a patch
+	if _, err := Patch(old, next, int64(len(next))); err == nil {
+		t.Fatal("garbage applied as a patch")
+	}
+}
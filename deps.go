@@ -0,0 +1,100 @@
+package debora
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+/*
+	Module dependencies.
+	Before building, debora downloads the new commit's module dependencies
+	and checks them against its go.sum, so a new dependency can't break the build
+	halfway and a failed download is reported as its own stage.
+	The proxy is the daemon's GOPROXY, or the one set by the app with SetGoProxy.
+	Offline nodes can use a file:// proxy, eg. a copy of a module cache's download dir,
+	or releases with vendored modules, which need no download at all.
+*/
+
+// GOPROXY for this app's upgrades, sent to debora in Add
+var goProxy string
+
+// Set the GOPROXY debora downloads the app's dependencies from,
+// eg. "https://proxy.golang.org,direct" or "file:///srv/goproxy".
+// Must be called before Add
+func SetGoProxy(proxy string) {
+	goProxy = proxy
+}
+
+func hasGoMod(dir string) bool {
+	_, err := os.Stat(path.Join(dir, "go.mod"))
+	return err == nil
+}
+
+func hasVendor(dir string) bool {
+	_, err := os.Stat(path.Join(dir, "vendor", "modules.txt"))
+	return err == nil
+}
+
+// Environment for the go tool in dir
+func (deb *Debora) moduleEnv(dir string) []string {
+	if !hasGoMod(dir) {
+		return nil
+	}
+	var env []string
+	proxy := deb.deb.GoProxy
+	if proxy != "" {
+		env = append(env, "GOPROXY="+proxy)
+	} else {
+		proxy = os.Getenv("GOPROXY")
+	}
+	if strings.HasPrefix(proxy, "file://") || proxy == "off" {
+		// offline. go.sum is all we check against
+		env = append(env, "GOSUMDB=off")
+	}
+	if hasVendor(dir) {
+		env = append(env, "GOFLAGS="+withModFlag("vendor"))
+	} else {
+		// never let the build change go.mod or go.sum
+		env = append(env, "GOFLAGS="+withModFlag("readonly"))
+	}
+	return env
+}
+
+// The daemon's GOFLAGS, with its -mod flag replaced by mode
+func withModFlag(mode string) string {
+	var flags []string
+	for _, f := range strings.Fields(os.Getenv("GOFLAGS")) {
+		if !strings.HasPrefix(f, "-mod=") && !strings.HasPrefix(f, "--mod=") {
+			flags = append(flags, f)
+		}
+	}
+	return strings.Join(append(flags, "-mod="+mode), " ")
+}
+
+// Download dir's module dependencies and verify them against go.sum
+func (deb *Debora) downloadDeps(dir string) error {
+	if !hasGoMod(dir) {
+		deb.Logln("No go.mod. Dependencies must already be in GOPATH")
+		return nil
+	}
+	if hasVendor(dir) {
+		deb.Logln("Using vendored modules")
+		return nil
+	}
+	env := deb.moduleEnv(dir)
+	for _, args := range [][]string{{"mod", "download", "-x"}, {"mod", "verify"}} {
+		cmd := exec.Command("go", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), env...)
+		cmd.Stdout = deb.logWriter()
+		cmd.Stderr = deb.logWriter()
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("go %s failed: %s", strings.Join(args, " "), err.Error())
+		}
+	}
+	deb.Logln("Dependencies downloaded and verified")
+	return nil
+}
@@ -0,0 +1,165 @@
+package debora
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+	Upgrade directives.
+	An upgrade message carries a list of directives, run in order:
+	upgrade the app, upgrade debora, run a migration, change the app's args,
+	or just restart. The whole list is validated before anything is done.
+	Everything is built into the staging dir first, and only once every
+	directive has succeeded are the binaries swapped in and the app restarted,
+	so a failing directive leaves the app as it was.
+	Migrations run last, with the app stopped, and a failing one
+	is undone by restoring its snapshot and the old binary.
+	A message with only a Commit is a single upgrade-app directive,
+	and the old "cmd:hash" form is an upgrade-debora directive.
+*/
+
+const (
+	DirectiveUpgradeApp    = "upgrade-app"    // fetch, build and install Commit of the app
+	DirectiveUpgradeDebora = "upgrade-debora" // fetch, build and install Commit of debora
+	DirectiveMigrate       = "migrate"        // run Args with the app stopped, before it restarts
+	DirectiveSetArgs       = "set-args"       // restart the app with Args as its arguments
+	DirectiveRestart       = "restart"        // restart the app, even without code changes
+)
+
+// A step of an upgrade
+type Directive struct {
+	Op     string
+	Commit string   `json:",omitempty"`
+	Args   []string `json:",omitempty"`
+}
+
+func (d Directive) String() string {
+	switch d.Op {
+	case DirectiveUpgradeApp, DirectiveUpgradeDebora:
+		return d.Op + "=" + d.Commit
+	case DirectiveMigrate, DirectiveSetArgs:
+		return d.Op + "=" + strings.Join(d.Args, " ")
+	}
+	return d.Op
+}
+
+// Parse a directive given as op or op=value, eg. upgrade-app=v1.4.2,
+// "migrate=./migrate up" or restart
+func ParseDirective(s string) (Directive, error) {
+	op, value := s, ""
+	if i := strings.Index(s, "="); i >= 0 {
+		op, value = s[:i], s[i+1:]
+	}
+	d := Directive{Op: op}
+	switch op {
+	case DirectiveUpgradeApp, DirectiveUpgradeDebora:
+		d.Commit = value
+	case DirectiveMigrate, DirectiveSetArgs:
+		d.Args = strings.Fields(value)
+	}
+	return d, d.validate()
+}
+
+func (d Directive) validate() error {
+	switch d.Op {
+	case DirectiveUpgradeApp, DirectiveUpgradeDebora:
+		if err := validRef(d.Commit); err != nil {
+			return fmt.Errorf("Bad %s directive: %s", d.Op, err.Error())
+		}
+	case DirectiveMigrate:
+		if len(d.Args) == 0 {
+			return fmt.Errorf("Migrate directive needs a command")
+		}
+	case DirectiveSetArgs, DirectiveRestart:
+	default:
+		return fmt.Errorf("Unknown upgrade directive %q", d.Op)
+	}
+	return nil
+}
+
+// The message's directives, validated
+func directives(reqObj UpgradeMsg) ([]Directive, error) {
+	ds := reqObj.Directives
+	if len(ds) == 0 {
+		// the old single commit form
+		spl := strings.Split(reqObj.Commit, ":")
+		switch len(spl) {
+		case 1:
+			ds = []Directive{{Op: DirectiveUpgradeApp, Commit: reqObj.Commit}}
+		case 2:
+			ds = []Directive{{Op: DirectiveUpgradeDebora, Commit: spl[1]}}
+		default:
+			return nil, fmt.Errorf("Unknown upgrade directive: %s", reqObj.Commit)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, d := range ds {
+		if err := d.validate(); err != nil {
+			return nil, err
+		}
+		if (d.Op == DirectiveUpgradeApp || d.Op == DirectiveUpgradeDebora) && seen[d.Op] {
+			return nil, fmt.Errorf("Only one %s directive is allowed", d.Op)
+		}
+		seen[d.Op] = true
+	}
+	return ds, nil
+}
+
+// The commit of the app upgrade, if there is one
+func appCommit(ds []Directive) string {
+	for _, d := range ds {
+		if d.Op == DirectiveUpgradeApp {
+			return d.Commit
+		}
+	}
+	return ""
+}
+
+// Whether the directives only upgrade the app to the commit it runs.
+// The commit may be abbreviated
+func alreadyRunning(ds []Directive, running string) bool {
+	if running == "" || len(ds) != 1 || ds[0].Op != DirectiveUpgradeApp {
+		return false
+	}
+	c := ds[0].Commit
+	return c == running || (len(c) >= 7 && strings.HasPrefix(running, c))
+}
+
+// A label for the directives, used as the message's Commit
+// when there's no app upgrade
+func DirectivesLabel(ds []Directive) string {
+	if c := appCommit(ds); c != "" {
+		return c
+	}
+	var ops []string
+	for _, d := range ds {
+		ops = append(ops, d.String())
+	}
+	return strings.Join(ops, ",")
+}
+
+// The migrations for the new debora to run: the release's,
+// followed by the migrate directives
+func migrationsFor(ds []Directive, env HookEnv) (*MigrationSpec, error) {
+	var spec *MigrationSpec
+	if env.Dir != "" && env.Dir != env.Src {
+		var err error
+		if spec, err = loadMigrations(env.Dir); err != nil {
+			return nil, err
+		}
+	}
+	for _, d := range ds {
+		if d.Op != DirectiveMigrate {
+			continue
+		}
+		if spec == nil {
+			spec = &MigrationSpec{Dir: env.Src}
+			if env.Dir != "" {
+				spec.Dir = env.Dir
+			}
+		}
+		spec.Migrations = append(spec.Migrations, Migration{Command: d.Args})
+	}
+	return spec, nil
+}
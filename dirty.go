@@ -0,0 +1,104 @@
+package debora
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+	Dirty tree policy.
+	App upgrades are built in their own worktrees, but debora's own checkout
+	is upgraded in place, where local changes can get in the way.
+	The app picks what to do about them with SetDirtyPolicy before Add.
+	Staged, unstaged and untracked files all count as changes.
+	Whatever is done is recorded in the upgrade log.
+*/
+
+// What to do with local changes in a checkout upgraded in place
+const (
+	DirtyAbort  = "abort"  // abort the upgrade (the default)
+	DirtyStash  = "stash"  // stash the changes and re-apply them after the checkout
+	DirtyReset  = "reset"  // throw the changes away
+	DirtyIgnore = "ignore" // check out over them, failing if git refuses
+)
+
+// policy for this app, sent to debora in Add
+var dirtyPolicy string
+
+// Set what debora does with local changes in a checkout it upgrades in place.
+// Must be called before Add
+func SetDirtyPolicy(policy string) error {
+	switch policy {
+	case DirtyAbort, DirtyStash, DirtyReset, DirtyIgnore:
+		dirtyPolicy = policy
+		return nil
+	}
+	return fmt.Errorf("Unknown dirty tree policy: %s", policy)
+}
+
+// Local changes in src: staged, unstaged and untracked files.
+// Empty if the tree is clean
+func (deb *Debora) localChanges(src string) (string, error) {
+	out, err := deb.git(src, "status", "--porcelain", "--untracked-files=all")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// Apply the policy to src before checking out a new commit.
+// Returns whether the changes were stashed
+func (deb *Debora) cleanTree(src, policy string) (bool, error) {
+	changes, err := deb.localChanges(src)
+	if err != nil {
+		return false, err
+	}
+	if changes == "" {
+		return false, nil
+	}
+	if policy == "" {
+		policy = DirtyAbort
+	}
+	deb.Logf(fmt.Sprintf("Working tree %s has local changes:\n%s\n", src, changes))
+
+	switch policy {
+	case DirtyAbort:
+		deb.Logln("Working tree is dirty. Aborting upgrade.")
+		return false, fmt.Errorf("Working tree %s is dirty", src)
+	case DirtyStash:
+		msg := "debora upgrade " + time.Now().UTC().Format(time.RFC3339)
+		if _, err := deb.git(src, "stash", "push", "--include-untracked", "-m", msg); err != nil {
+			return false, err
+		}
+		deb.Logf(fmt.Sprintf("Stashed local changes as %q\n", msg))
+		return true, nil
+	case DirtyReset:
+		if _, err := deb.git(src, "reset", "--hard"); err != nil {
+			return false, err
+		}
+		if _, err := deb.git(src, "clean", "-fd"); err != nil {
+			return false, err
+		}
+		deb.Logln("Discarded local changes")
+		return false, nil
+	case DirtyIgnore:
+		deb.Logln("Ignoring local changes")
+		return false, nil
+	}
+	return false, fmt.Errorf("Unknown dirty tree policy: %s", policy)
+}
+
+// Re-apply stashed changes after the checkout.
+// If they conflict with the new commit, the checkout is left clean
+// and the changes are kept in the stash
+func (deb *Debora) restoreStash(src string) {
+	if _, err := deb.git(src, "stash", "apply"); err != nil {
+		deb.git(src, "reset", "--hard")
+		deb.git(src, "clean", "-fd")
+		deb.Logln("Local changes conflict with the upgrade. They are kept in the stash")
+		return
+	}
+	deb.git(src, "stash", "drop")
+	deb.Logln("Re-applied stashed local changes")
+}
@@ -0,0 +1,238 @@
+package debora
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+/*
+	Gossip relay for upgrade messages.
+	The developer's peer only hands the upgrade message to its own neighbors.
+	To reach peers further away, `debora call --gossip-ttl N` wraps the message
+	in an envelope signed by the developer's key, and every peer that receives it
+	checks the signature against the key given to Add, passes it on to its
+	own neighbors with one less hop to go, and then hands it to its debora.
+	The app gives debora a function to send to its neighbors with SetGossipSender,
+	and passes the envelopes it receives to Call, like any upgrade message.
+	Envelopes are deduplicated by id, the hash of the signed bytes, so each is relayed once,
+	and the peer each came from is kept, to route tunneled requests back to the developer.
+	Envelopes that fail verification are dropped, never relayed.
+	The hop count isn't signed, so it is capped at MaxGossipTTL.
+	Unless the upgrade is tunneled, relayed peers can't reach the developer through
+	the peer that delivered the message, so the message's Host must be the developer's public address.
+*/
+
+var (
+	MaxGossipTTL    = 16             // most hops a message is relayed
+	GossipRetention = 24 * time.Hour // how long to remember the ids of relayed messages
+)
+
+const gossipMagic = "DBGOSSP1"
+
+// A peer's record of the messages it relayed, and where it passes them on
+type gossipRelay struct {
+	dir string // defaults to gossipDir()
+
+	// sends a message to all the app's neighbors.
+	// set by the app
+	send func(msg []byte)
+
+	// hands a verified upgrade message to debora
+	deliver func(m UpgradeMsg, route *TunnelRoute) error
+
+	mtx sync.Mutex
+}
+
+// The app's relay
+var localGossip = &gossipRelay{
+	deliver: func(m UpgradeMsg, route *TunnelRoute) error {
+		return callDebora(m, m.Host, route)
+	},
+}
+
+// A signed upgrade message relayed between peers
+type Gossip struct {
+	ID      string // hex encoded sha256 of the message's sign bytes
+	TTL     int    // hops left
+	Payload []byte // the binary encoded upgrade message
+	Sig     string // hex encoded signature of the id by the developer's key
+}
+
+// Wrap the upgrade message in a signed gossip envelope, relayed for ttl hops.
+// Run by the developer
+func NewGossip(m UpgradeMsg, privHex string, ttl int) ([]byte, error) {
+	if ttl < 1 || ttl > MaxGossipTTL {
+		return nil, fmt.Errorf("Gossip ttl must be between 1 and %d", MaxGossipTTL)
+	}
+	sum := sha256.Sum256(UpgradeSignBytes(m))
+	sig, err := Sign(privHex, sum[:])
+	if err != nil {
+		return nil, err
+	}
+	g := Gossip{
+		ID:      hex.EncodeToString(sum[:]),
+		TTL:     ttl,
+		Payload: EncodeUpgrade(m),
+		Sig:     hex.EncodeToString(sig),
+	}
+	return encodeGossip(g), nil
+}
+
+// Set the function debora uses to send gossip to all the app's neighbors
+func SetGossipSender(send func(msg []byte)) {
+	localGossip.send = send
+}
+
+func isGossip(p []byte) bool {
+	return bytes.HasPrefix(p, []byte(gossipMagic))
+}
+
+func encodeGossip(g Gossip) []byte {
+	var e encoder
+	e.buf.WriteString(gossipMagic)
+	e.string(g.ID)
+	e.varint(int64(g.TTL))
+	e.bytes(g.Payload)
+	e.string(g.Sig)
+	return e.buf.Bytes()
+}
+
+func decodeGossip(p []byte) (Gossip, error) {
+	var g Gossip
+	d := decoder{p: p[len(gossipMagic):]}
+	g.ID = d.string()
+	g.TTL = d.int()
+	g.Payload = d.bytes()
+	g.Sig = d.string()
+	if d.err != nil {
+		return g, fmt.Errorf("Bad gossip message: %s", d.err.Error())
+	}
+	if len(d.p) > 0 {
+		return g, fmt.Errorf("Bad gossip message: %d trailing bytes", len(d.p))
+	}
+	return g, nil
+}
+
+// Check the envelope was signed by the developer, returning the upgrade message
+func (g Gossip) verify(pubHex string) (UpgradeMsg, error) {
+	m, err := DecodeUpgrade(g.Payload)
+	if err != nil {
+		return m, err
+	}
+	// the payload is canonical, in whatever format the developer used
+	sum := sha256.Sum256(append([]byte(upgradeSignPrefix), g.Payload...))
+	if hex.EncodeToString(sum[:]) != g.ID {
+		return m, fmt.Errorf("Gossip id doesn't match its message")
+	}
+	sig, err := hex.DecodeString(g.Sig)
+	if err != nil {
+		return m, fmt.Errorf("Gossip signature is not valid hex")
+	}
+	if err := Verify(pubHex, sum[:], sig); err != nil {
+		return m, fmt.Errorf("Invalid gossip signature: %s", err.Error())
+	}
+	return m, nil
+}
+
+func gossipDir() string {
+	return path.Join(DeboraRoot, "gossip")
+}
+
+func (r *gossipRelay) root() string {
+	if r.dir != "" {
+		return r.dir
+	}
+	return gossipDir()
+}
+
+// Mark the message from peer as relayed. Returns false if it already was.
+// Relayed messages are recorded under the debora root,
+// so they're remembered across the restart of an upgrade
+func (r *gossipRelay) mark(id, peer string) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	dir := r.root()
+	if files, err := ioutil.ReadDir(dir); err == nil {
+		for _, f := range files {
+			if time.Since(f.ModTime()) > GossipRetention {
+				os.Remove(path.Join(dir, f.Name()))
+			}
+		}
+	}
+	file := path.Join(dir, id)
+	if _, err := os.Stat(file); err == nil {
+		return false
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		logger.Println("Error recording gossip:", err)
+	} else if err := ioutil.WriteFile(file, []byte(peer), 0600); err != nil {
+		logger.Println("Error recording gossip:", err)
+	}
+	return true
+}
+
+// The peer a relayed message came from, the way back to the developer
+func (r *gossipRelay) upstream(id string) string {
+	// ids are sha256 hashes, like chunks
+	if !isChunkHash(id) {
+		return ""
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	b, err := ioutil.ReadFile(path.Join(r.root(), id))
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+func gossipUpstream(id string) string {
+	return localGossip.upstream(id)
+}
+
+// Verify a gossip envelope received from peer, relay it,
+// and hand the upgrade message to debora
+func handleGossip(peer string, p []byte) error {
+	if deboraKey == "" {
+		return fmt.Errorf("This process is not known to debora. Did you run Add first?")
+	}
+	return localGossip.handle(deboraKey, peer, p)
+}
+
+// Verify an envelope against the developer's key, relay it, and deliver it
+func (r *gossipRelay) handle(key, peer string, p []byte) error {
+	g, err := decodeGossip(p)
+	if err != nil {
+		return err
+	}
+	m, err := g.verify(key)
+	if err != nil {
+		logger.Printf("Dropping gossip from %s: %s\n", peer, err.Error())
+		return err
+	}
+	if !r.mark(g.ID, peer) {
+		return nil
+	}
+
+	// relay before the upgrade, which stops the app
+	if g.TTL > MaxGossipTTL {
+		g.TTL = MaxGossipTTL
+	}
+	if g.TTL > 1 && r.send != nil {
+		g.TTL--
+		logger.Printf("Relaying upgrade %s to neighbors (ttl %d)\n", m.Commit, g.TTL)
+		r.send(encodeGossip(g))
+	}
+	var route *TunnelRoute
+	if m.Tunnel {
+		route = &TunnelRoute{Peer: peer, Gossip: g.ID}
+	}
+	return r.deliver(m, route)
+}
@@ -0,0 +1,206 @@
+package debora
+
+import (
+	"path"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// An upgrade message handed to a peer's debora
+type testDelivery struct {
+	peer  int
+	msg   UpgradeMsg
+	route *TunnelRoute
+}
+
+// Gossip relays for each peer of the network, recording under dir
+// and delivering to the channel
+func testRelays(net *testNet, dir string, delivered chan testDelivery) []*gossipRelay {
+	relays := make([]*gossipRelay, len(net.inbox))
+	for i := range relays {
+		i := i
+		send := net.sender(i)
+		relays[i] = &gossipRelay{
+			dir:  path.Join(dir, "peer"+strconv.Itoa(i)),
+			send: func(msg []byte) { send("", msg) },
+			deliver: func(m UpgradeMsg, route *TunnelRoute) error {
+				delivered <- testDelivery{peer: i, msg: m, route: route}
+				return nil
+			},
+		}
+	}
+	return relays
+}
+
+// Wait for n deliveries, then make sure no more come
+func waitDeliveries(t *testing.T, delivered chan testDelivery, n int) []testDelivery {
+	var got []testDelivery
+	for len(got) < n {
+		select {
+		case d := <-delivered:
+			got = append(got, d)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("only %d of %d peers got the upgrade", len(got), n)
+		}
+	}
+	select {
+	case d := <-delivered:
+		t.Fatalf("peer %d got an extra upgrade", d.peer)
+	case <-time.After(200 * time.Millisecond):
+	}
+	return got
+}
+
+// A line of peers, each connected to the one before and after it
+func lineNet(n int) *testNet {
+	return newTestNet(n, func(i int) []int {
+		var nbrs []int
+		if i > 0 {
+			nbrs = append(nbrs, i-1)
+		}
+		if i+1 < n {
+			nbrs = append(nbrs, i+1)
+		}
+		return nbrs
+	})
+}
+
+// Twelve peers relay a tunneled upgrade from the developer's peer,
+// each delivering it once, and remembering it across a restart
+func TestGossipMesh(t *testing.T) {
+	const peers = 12
+	priv, pub := testKey(t, 0)
+	tmp := t.TempDir()
+	net := newTestNet(peers, func(i int) []int {
+		return []int{(i + 1) % peers, (i + peers - 1) % peers, (i + 5) % peers}
+	})
+	defer net.close()
+	delivered := make(chan testDelivery, 4*peers)
+	relays := testRelays(net, tmp, delivered)
+	for i := 1; i < peers; i++ {
+		r := relays[i]
+		net.serve(i, func(peer string, msg []byte) {
+			if err := r.handle(pub, peer, msg); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+
+	m := testUpgradeMsg()
+	env, err := NewGossip(m, priv, MaxGossipTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := decodeGossip(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	net.sender(0)("", env)
+
+	seen := make(map[int]bool)
+	for _, d := range waitDeliveries(t, delivered, peers-1) {
+		if seen[d.peer] {
+			t.Fatalf("peer %d got the upgrade twice", d.peer)
+		}
+		seen[d.peer] = true
+		if d.msg.Commit != m.Commit {
+			t.Fatalf("peer %d got commit %s", d.peer, d.msg.Commit)
+		}
+		// tunneled requests go back the way the message came
+		if d.route == nil || d.route.Gossip != g.ID || d.route.Peer != relays[d.peer].upstream(g.ID) {
+			t.Fatalf("peer %d has a bad route %+v", d.peer, d.route)
+		}
+	}
+
+	// after an upgrade, the peer's new relay has the same record
+	restarted := testRelays(net, tmp, delivered)[3]
+	sent := false
+	restarted.send = func(msg []byte) { sent = true }
+	if err := restarted.handle(pub, "2", env); err != nil {
+		t.Fatal(err)
+	}
+	if sent || len(delivered) > 0 {
+		t.Fatal("a restarted peer relayed the upgrade again")
+	}
+}
+
+// Messages go as many hops as their ttl, and no more than MaxGossipTTL
+func TestGossipTTL(t *testing.T) {
+	priv, pub := testKey(t, 0)
+	oldMax := MaxGossipTTL
+	MaxGossipTTL = 3
+	defer func() { MaxGossipTTL = oldMax }()
+
+	env, err := NewGossip(testUpgradeMsg(), priv, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := decodeGossip(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the ttl isn't signed, so a peer can raise it
+	g.TTL = 100
+	raised := encodeGossip(g)
+	if _, err := NewGossip(testUpgradeMsg(), priv, 100); err == nil {
+		t.Fatal("made gossip with a ttl over the max")
+	}
+
+	for _, tc := range []struct {
+		env  []byte
+		hops int
+	}{{env, 2}, {raised, 3}} {
+		net := lineNet(6)
+		delivered := make(chan testDelivery, 16)
+		relays := testRelays(net, t.TempDir(), delivered)
+		for i := 1; i < 6; i++ {
+			r := relays[i]
+			net.serve(i, func(peer string, msg []byte) { r.handle(pub, peer, msg) })
+		}
+		net.sender(0)("", tc.env)
+		for _, d := range waitDeliveries(t, delivered, tc.hops) {
+			if d.peer > tc.hops {
+				t.Fatalf("upgrade went %d hops, expected %d", d.peer, tc.hops)
+			}
+		}
+		net.close()
+	}
+}
+
+// Envelopes that fail verification are neither relayed, recorded nor delivered
+func TestGossipBadSignature(t *testing.T) {
+	priv, pub := testKey(t, 0)
+	otherPriv, _ := testKey(t, 1)
+	delivered := make(chan testDelivery, 1)
+	net := lineNet(2)
+	defer net.close()
+	r := testRelays(net, t.TempDir(), delivered)[1]
+	sent := false
+	r.send = func(msg []byte) { sent = true }
+
+	forged, err := NewGossip(testUpgradeMsg(), otherPriv, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a signed envelope with another message swapped in
+	env, err := NewGossip(testUpgradeMsg(), priv, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, _ := decodeGossip(env)
+	m := testUpgradeMsg()
+	m.Commit = "evil"
+	g.Payload = EncodeUpgrade(m)
+	swapped := encodeGossip(g)
+
+	for name, env := range map[string][]byte{"forged": forged, "swapped": swapped} {
+		if err := r.handle(pub, "0", env); err == nil {
+			t.Fatalf("accepted a %s envelope", name)
+		}
+		g, _ := decodeGossip(env)
+		if sent || len(delivered) > 0 || r.upstream(g.ID) != "" {
+			t.Fatalf("a %s envelope got through", name)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package debora
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime/debug"
+)
+
+/*
+	Helpers for running the go tool, in module mode or GOPATH mode.
+	The environment is passed through to the go tool,
+	so GOFLAGS, GOPROXY and toolchain directives in go.mod are honored.
+*/
+
+// Import path of debora's daemon
+const DeboraPkg = "github.com/ebuchman/debora/cmd/debora"
+
+// package to install for this app, relative to its source dir.
+// sent to debora in Add
+var installPkg string
+
+// Set the main package debora installs on upgrades, eg. "./cmd/node".
+// Defaults to the root of the source dir.
+// Must be called before Add
+func SetInstallPackage(pkg string) {
+	installPkg = pkg
+}
+
+// GOPATH, or its default
+func goPath() string {
+	if p := os.Getenv("GOPATH"); p != "" {
+		return filepath.SplitList(p)[0]
+	}
+	return path.Join(HomeDir, "go")
+}
+
+// where `go install` puts binaries
+func goBin() string {
+	if b := os.Getenv("GOBIN"); b != "" {
+		return b
+	}
+	return path.Join(goPath(), "bin")
+}
+
+// debora's own source, if there is a local checkout
+func deboraSrcPath() string {
+	if s := os.Getenv("DEBORA_SRC"); s != "" {
+		return s
+	}
+	return path.Join(goPath(), "src", "github.com", "ebuchman", "debora")
+}
+
+// Full path to an app's source.
+// Absolute paths are used as they are (eg. module mode checkouts),
+// others are relative to $GOPATH/src
+func srcPath(src string) string {
+	if filepath.IsAbs(src) {
+		return src
+	}
+	return path.Join(GoSrc, src)
+}
+
+// Version of debora this binary was built with, for installing the daemon.
+// Falls back to the latest version
+func deboraVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if ok {
+		for _, dep := range info.Deps {
+			if dep.Path == "github.com/ebuchman/debora" && dep.Version != "" && dep.Version != "(devel)" {
+				return dep.Version
+			}
+		}
+	}
+	return "latest"
+}
+
+// Run `go install pkg` in dir, writing output to out.
+// If gobin is not empty, the binaries are installed there.
+// env is added to the environment and flags are passed to `go install`
+func goInstall(dir, pkg, gobin string, out io.Writer, env []string, flags ...string) error {
+	if pkg == "" {
+		pkg = "."
+	}
+	args := append([]string{"install", "-v"}, flags...)
+	cmd := exec.Command("go", append(args, pkg)...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	if gobin != "" {
+		if err := os.MkdirAll(gobin, 0700); err != nil {
+			return err
+		}
+		cmd.Env = append(cmd.Env, "GOBIN="+gobin)
+	}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	return cmd.Run()
+}
@@ -0,0 +1,280 @@
+package debora
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	User defined lifecycle hooks around upgrades and restarts.
+	A hook is either a command, registered by the app with AddHook before calling Add
+	and run by the daemon, or a go callback, registered with AddHookFunc before calling Add
+	and run in the app process that registered it. Add tells the daemon which stages
+	have callbacks, and the app long-polls the daemon for the stages to run them at,
+	handing back the result with its next poll. Post-start callbacks run once the
+	restarted app has added itself. A stage's commands run before its callbacks,
+	each in the order they were added.
+	Hooks receive the old and new commit through the environment.
+	A failing pre-* hook aborts the upgrade. Failures of other hooks are only logged.
+*/
+
+var (
+	HookFuncTimeout   = 10 * time.Minute // how long debora waits for the app's callbacks to run
+	HookPickupTimeout = 1 * time.Minute  // how long debora waits for the app to poll for a stage
+	HookPollTimeout   = 20 * time.Second // how long the app's poll waits for a stage
+)
+
+// Lifecycle stages at which hooks are run
+const (
+	HookPreFetch     = "pre-fetch"
+	HookPostCheckout = "post-checkout"
+	HookPostInstall  = "post-install"
+	HookPreStop      = "pre-stop"
+	HookPostStart    = "post-start"
+	HookOnFailure    = "on-failure"
+)
+
+var hookStages = []string{
+	HookPreFetch,
+	HookPostCheckout,
+	HookPostInstall,
+	HookPreStop,
+	HookPostStart,
+	HookOnFailure,
+}
+
+// Information about the upgrade passed to every hook
+type HookEnv struct {
+	App       string
+	Stage     string
+	Src       string // full path to the app's source
+	Dir       string // where the new commit is checked out and built
+	OldCommit string // commit running before the upgrade
+	NewCommit string // commit being upgraded to
+	Binary    string // name of the new binary, once installed
+}
+
+// Environment variables handed to hook commands
+func (e HookEnv) Environ() []string {
+	return []string{
+		"DEBORA_APP=" + e.App,
+		"DEBORA_STAGE=" + e.Stage,
+		"DEBORA_APP_SRC=" + e.Src,
+		"DEBORA_DIR=" + e.Dir,
+		"DEBORA_OLD_COMMIT=" + e.OldCommit,
+		"DEBORA_NEW_COMMIT=" + e.NewCommit,
+		"DEBORA_BINARY=" + e.Binary,
+	}
+}
+
+// A go callback run at a lifecycle stage
+type HookFunc func(env HookEnv) error
+
+var (
+	hookCmds  = make(map[string][][]string) // commands sent to debora by this process in Add
+	hookFuncs = make(map[string][]HookFunc) // callbacks run in this process
+
+	// stages for the app to run its callbacks at, waiting for the app to poll
+	hookOut = make(chan HookCall)
+
+	hookMtx     sync.Mutex
+	hookWaiting = make(map[string]chan HookResult) // stages waiting for the app's result, by id
+)
+
+func validHookStage(stage string) bool {
+	for _, s := range hookStages {
+		if s == stage {
+			return true
+		}
+	}
+	return false
+}
+
+// Register a command to run at the given stage of every upgrade.
+// Must be called before Add, which hands the commands to debora.
+func AddHook(stage string, args ...string) error {
+	if !validHookStage(stage) {
+		return fmt.Errorf("Unknown hook stage: %s", stage)
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("Hook command must not be empty")
+	}
+	hookCmds[stage] = append(hookCmds[stage], args)
+	return nil
+}
+
+// Register a go callback to run at the given stage of every upgrade.
+// It runs in this process, so it must be registered before calling Add
+func AddHookFunc(stage string, fn HookFunc) error {
+	if !validHookStage(stage) {
+		return fmt.Errorf("Unknown hook stage: %s", stage)
+	}
+	hookFuncs[stage] = append(hookFuncs[stage], fn)
+	return nil
+}
+
+// Stages this process has callbacks for, sent to debora in Add
+func hookFuncStages() []string {
+	var stages []string
+	for _, stage := range hookStages {
+		if len(hookFuncs[stage]) > 0 {
+			stages = append(stages, stage)
+		}
+	}
+	return stages
+}
+
+// Run the commands and the app's callbacks for a stage.
+// Errors are only returned for pre-* stages,
+// otherwise they are logged and the upgrade continues
+func (deb *Debora) runHooks(hooks map[string][][]string, env HookEnv) error {
+	err := runHooks(hooks, env)
+	// post-start callbacks run once the restarted app adds itself
+	if err == nil && env.Stage != HookPostStart {
+		err = deb.callHookFuncs(env)
+	}
+	if err == nil {
+		return nil
+	}
+	deb.Logf(fmt.Sprintf("Hook %s failed: %s\n", env.Stage, err.Error()))
+	if strings.HasPrefix(env.Stage, "pre-") {
+		return err
+	}
+	return nil
+}
+
+func runHooks(hooks map[string][][]string, env HookEnv) error {
+	for _, args := range hooks[env.Stage] {
+		if len(args) == 0 {
+			continue
+		}
+		buf := new(bytes.Buffer)
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Env = append(os.Environ(), env.Environ()...)
+		cmd.Dir = env.Src
+		if env.Dir != "" {
+			cmd.Dir = env.Dir
+		}
+		cmd.Stdout = buf
+		cmd.Stderr = buf
+		err := cmd.Run()
+		logger.Printf("Hook %s output: %s", env.Stage, buf.Bytes())
+		if err != nil {
+			return fmt.Errorf("%s: %s", strings.Join(args, " "), err.Error())
+		}
+	}
+	return nil
+}
+
+// Have the app run its callbacks for the stage, if it has any, and wait for the result.
+// Runs in the daemon
+func (deb *Debora) callHookFuncs(env HookEnv) error {
+	if !isIn(env.Stage, deb.deb.HookFuncs) {
+		return nil
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	call := HookCall{ID: hex.EncodeToString(id), Env: env}
+	ch := make(chan HookResult, 1)
+	hookMtx.Lock()
+	hookWaiting[call.ID] = ch
+	hookMtx.Unlock()
+	defer func() {
+		hookMtx.Lock()
+		delete(hookWaiting, call.ID)
+		hookMtx.Unlock()
+	}()
+
+	select {
+	case hookOut <- call:
+	case <-time.After(HookPickupTimeout):
+		return fmt.Errorf("The app didn't poll for its %s callbacks", env.Stage)
+	}
+	select {
+	case res := <-ch:
+		if res.Error != "" {
+			return fmt.Errorf("callback: %s", res.Error)
+		}
+		return nil
+	case <-time.After(HookFuncTimeout):
+		return fmt.Errorf("No result from the app's %s callbacks", env.Stage)
+	}
+}
+
+// Hand the app's result to the stage waiting for it.
+// Runs in the daemon
+func hookResult(res HookResult) {
+	hookMtx.Lock()
+	defer hookMtx.Unlock()
+	if ch, ok := hookWaiting[res.ID]; ok {
+		select {
+		case ch <- res:
+		default:
+			// already answered
+		}
+	}
+}
+
+// Wait up to the poll timeout for a stage to run callbacks at.
+// Runs in the daemon
+func hookCallFor() *HookCall {
+	select {
+	case call := <-hookOut:
+		return &call
+	case <-time.After(HookPollTimeout):
+		return nil
+	}
+}
+
+// Run the callbacks for a stage, in order, until one fails
+func runHookFuncs(env HookEnv) error {
+	for _, fn := range hookFuncs[env.Stage] {
+		if err := fn(env); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pick up the stages debora runs our callbacks at, run them,
+// and hand back the result with the next poll.
+// Runs in the app process
+func pollHooks(c *Client, pid int) {
+	var result *HookResult
+	for {
+		resp, err := c.Hook(context.Background(), HookPoll{Pid: pid, Result: result})
+		if err != nil {
+			logger.Println("Error polling debora for hooks:", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		result = nil
+		if call := resp.Call; call != nil {
+			result = &HookResult{ID: call.ID}
+			if err := runHookFuncs(call.Env); err != nil {
+				result.Error = err.Error()
+			}
+		}
+	}
+}
+
+// Get the commit currently checked out in src
+func gitHead(src string) (string, error) {
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = src
+	b, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("Git rev-parse error: %s", err.Error())
+	}
+	return strings.TrimSpace(string(b)), nil
+}
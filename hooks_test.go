@@ -0,0 +1,105 @@
+package debora
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The daemon hands a stage to the app's poll, and waits for the result of its callbacks
+func TestHookFuncs(t *testing.T) {
+	setDuration(t, &HookPollTimeout, 50*time.Millisecond)
+	setDuration(t, &HookPickupTimeout, 5*time.Second)
+	oldFuncs := hookFuncs
+	hookFuncs = make(map[string][]HookFunc)
+	defer func() { hookFuncs = oldFuncs }()
+
+	var ran []string
+	AddHookFunc(HookPreFetch, func(env HookEnv) error {
+		ran = append(ran, env.NewCommit)
+		return nil
+	})
+	AddHookFunc(HookPreFetch, func(env HookEnv) error {
+		if env.NewCommit == "bad" {
+			return fmt.Errorf("backup failed")
+		}
+		return nil
+	})
+	if err := AddHookFunc("pre-nothing", nil); err == nil {
+		t.Fatal("registered a callback for an unknown stage")
+	}
+
+	deb := &Debora{deb: AddRequest{Pid: os.Getpid(), HookFuncs: hookFuncStages()}}
+	if !reflect.DeepEqual(deb.deb.HookFuncs, []string{HookPreFetch}) {
+		t.Fatalf("bad callback stages %v", deb.deb.HookFuncs)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(deb.hook))
+	defer srv.Close()
+	c := NewClient(strings.TrimPrefix(srv.URL, "http://"))
+
+	// what pollHooks does, one poll at a time
+	poll := func(result *HookResult) *HookCall {
+		resp, err := c.Hook(context.Background(), HookPoll{Pid: os.Getpid(), Result: result})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Call
+	}
+	for _, commit := range []string{"good", "bad"} {
+		done := make(chan error, 1)
+		go func() { done <- deb.runHooks(nil, HookEnv{Stage: HookPreFetch, NewCommit: commit}) }()
+		call := poll(nil)
+		if call == nil || call.Env.NewCommit != commit {
+			t.Fatalf("expected the %s stage, got %+v", commit, call)
+		}
+		result := &HookResult{ID: call.ID}
+		if err := runHookFuncs(call.Env); err != nil {
+			result.Error = err.Error()
+		}
+		if next := poll(result); next != nil {
+			t.Fatalf("unexpected stage %+v", next)
+		}
+		err := <-done
+		if commit == "good" && err != nil {
+			t.Fatal(err)
+		}
+		if commit == "bad" && (err == nil || !strings.Contains(err.Error(), "backup failed")) {
+			t.Fatalf("a failing pre-fetch callback didn't abort the upgrade: %v", err)
+		}
+	}
+	if !reflect.DeepEqual(ran, []string{"good", "bad"}) {
+		t.Fatalf("callbacks ran for %v", ran)
+	}
+
+	// stages without callbacks don't wait for the app
+	if err := deb.callHookFuncs(HookEnv{Stage: HookPreStop}); err != nil {
+		t.Fatal(err)
+	}
+	// nor does an app that never polls hold up the upgrade forever
+	setDuration(t, &HookPickupTimeout, 50*time.Millisecond)
+	if err := deb.callHookFuncs(HookEnv{Stage: HookPreFetch}); err == nil {
+		t.Fatal("expected the stage to fail without a poll")
+	}
+}
+
+// Apps and daemons from before version 4 send one command per stage
+func TestHookCmdsOldShape(t *testing.T) {
+	for _, body := range []string{
+		`{"Version": 3, "Key": "k", "Pid": 1, "Args": ["node"], "App": "app", "Hooks": {"pre-fetch": ["backup", "db"]}}`,
+		`{"Version": 4, "Key": "k", "Pid": 1, "Args": ["node"], "App": "app", "Hooks": {"pre-fetch": [["backup", "db"]]}}`,
+	} {
+		var m AddRequest
+		if err := decodeMsg([]byte(body), &m); err != nil {
+			t.Fatal(err)
+		}
+		if want := (HookCmds{HookPreFetch: {{"backup", "db"}}}); !reflect.DeepEqual(m.Hooks, want) {
+			t.Fatalf("decoded %v, expected %v", m.Hooks, want)
+		}
+	}
+}
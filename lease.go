@@ -0,0 +1,191 @@
+package debora
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+/*
+	Restart coordination.
+	When the developer sets MaxDown on a call, each peer must hold a lease
+	on one of MaxDown restart slots before taking the app down.
+	Leases are handed out by the developer's call server.
+	The new debora gives the lease back once the restarted app has added itself again,
+	so at most MaxDown peers are down at once.
+	Leases expire after LeaseTimeout in case a peer never comes back,
+	and a peer gives up on the upgrade if no slot is free for LeaseWaitTimeout.
+	Only peers that passed the handshake get leases:
+	requests carry the token derived from the handshake's nonce,
+	and only the peer holding a lease can give it back.
+*/
+
+var (
+	LeaseTimeout      = 5 * time.Minute
+	LeaseWaitTimeout  = 30 * time.Minute
+	LeasePollInterval = time.Second
+)
+
+// A granted restart slot
+type lease struct {
+	token  string // of the peer holding it
+	expiry time.Time
+}
+
+// Restart slots handed out by the developer's call server
+type leaseTable struct {
+	maxDown int
+	leases  map[string]lease // by id
+}
+
+func newLeaseTable(maxDown int) *leaseTable {
+	return &leaseTable{
+		maxDown: maxDown,
+		leases:  make(map[string]lease),
+	}
+}
+
+// Grant a new lease to the peer with the token if a slot is free.
+// Returns the empty string if all slots are taken
+func (t *leaseTable) acquire(token string, now time.Time) (string, error) {
+	for id, l := range t.leases {
+		if now.After(l.expiry) {
+			delete(t.leases, id)
+		}
+	}
+	if t.maxDown > 0 && len(t.leases) >= t.maxDown {
+		return "", nil
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+	t.leases[id] = lease{token: token, expiry: now.Add(LeaseTimeout)}
+	return id, nil
+}
+
+// Give back the lease, if the peer with the token holds it
+func (t *leaseTable) release(id, token string) error {
+	l, ok := t.leases[id]
+	if !ok {
+		return fmt.Errorf("Unknown lease %s", id)
+	}
+	if l.token != token {
+		return fmt.Errorf("Lease %s belongs to another peer", id)
+	}
+	delete(t.leases, id)
+	return nil
+}
+
+// Body of lease and release requests
+type leaseRequest struct {
+	Token string // from the handshake
+	Lease string `json:",omitempty"` // lease to give back
+}
+
+/*
+	Client side, run by the peer's debora
+*/
+
+// Block until the developer grants us a restart slot,
+// or LeaseWaitTimeout passes
+func acquireLease(dev devConn) (string, error) {
+	body, err := json.Marshal(leaseRequest{Token: dev.token})
+	if err != nil {
+		return "", err
+	}
+	deadline := time.Now().Add(LeaseWaitTimeout)
+	for {
+		b, err := dev.request("lease", body)
+		if err != nil {
+			return "", err
+		}
+		if len(b) > 0 {
+			return string(b), nil
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("No restart slot was free for %s", LeaseWaitTimeout)
+		}
+		time.Sleep(LeasePollInterval)
+	}
+}
+
+// Give the restart slot back to the developer
+func releaseLease(dev devConn, id string) error {
+	body, err := json.Marshal(leaseRequest{Token: dev.token, Lease: id})
+	if err != nil {
+		return err
+	}
+	return dev.notify("release", body)
+}
+
+/*
+	Developer side call daemon routes
+*/
+
+// Read a lease request, checking its token
+func (deb *DeveloperDebora) readLeaseRequest(w http.ResponseWriter, r *http.Request) (leaseRequest, bool) {
+	var req leaseRequest
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return req, false
+	}
+	if err := json.Unmarshal(b, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return req, false
+	}
+	if !deb.authorized(req.Token) {
+		http.Error(w, "Unknown token. Handshake first", http.StatusUnauthorized)
+		return req, false
+	}
+	return req, true
+}
+
+// Did the token come from a handshake
+func (deb *DeveloperDebora) authorized(token string) bool {
+	deb.mtx.Lock()
+	defer deb.mtx.Unlock()
+	_, ok := deb.tokens[token]
+	return token != "" && ok
+}
+
+// Grant a restart slot. Responds with the lease id,
+// or an empty body if no slot is free
+func (deb *DeveloperDebora) lease(w http.ResponseWriter, r *http.Request) {
+	req, ok := deb.readLeaseRequest(w, r)
+	if !ok {
+		return
+	}
+	deb.mtx.Lock()
+	defer deb.mtx.Unlock()
+	id, err := deb.leases.acquire(req.Token, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if id != "" {
+		logger.Println("Granted restart lease to", r.RemoteAddr)
+	}
+	w.Write([]byte(id))
+}
+
+// Give back a restart slot
+func (deb *DeveloperDebora) release(w http.ResponseWriter, r *http.Request) {
+	req, ok := deb.readLeaseRequest(w, r)
+	if !ok {
+		return
+	}
+	deb.mtx.Lock()
+	defer deb.mtx.Unlock()
+	if err := deb.leases.release(req.Lease, req.Token); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	logger.Println("Restart lease released by", r.RemoteAddr)
+}
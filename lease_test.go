@@ -0,0 +1,66 @@
+package debora
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLeaseTable(t *testing.T) {
+	table := newLeaseTable(1)
+	now := time.Now()
+	a, err := table.acquire("a", now)
+	if err != nil || a == "" {
+		t.Fatalf("expected a lease, got %q %v", a, err)
+	}
+	if b, _ := table.acquire("b", now); b != "" {
+		t.Fatal("granted more than MaxDown leases")
+	}
+	// only the holder can free its slot
+	if err := table.release(a, "b"); err == nil {
+		t.Fatal("released another peer's lease")
+	}
+	if b, _ := table.acquire("b", now); b != "" {
+		t.Fatal("slot was freed by another peer")
+	}
+	if err := table.release(a, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := table.acquire("b", now); b == "" {
+		t.Fatal("slot wasn't freed by its holder")
+	}
+	// leases of peers that never came back expire
+	if c, _ := table.acquire("c", now.Add(LeaseTimeout+time.Second)); c == "" {
+		t.Fatal("lease didn't expire")
+	}
+}
+
+// A peer gives up when the developer never has a free slot
+func TestAcquireLeaseDeadline(t *testing.T) {
+	setDuration(t, &LeaseWaitTimeout, 50*time.Millisecond)
+	setDuration(t, &LeasePollInterval, 10*time.Millisecond)
+	dev := NewDeveloperDebora("", 1)
+	dev.tokens["a"] = ""
+	dev.tokens["b"] = ""
+	if id, _ := dev.leases.acquire("a", time.Now()); id == "" {
+		t.Fatal("expected a lease")
+	}
+	srv := httptest.NewServer(http.HandlerFunc(dev.lease))
+	defer srv.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := acquireLease(devConn{host: strings.TrimPrefix(srv.URL, "http://"), token: "b"})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("got a lease while the slot was taken")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("still waiting for a lease")
+	}
+}
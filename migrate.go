@@ -0,0 +1,258 @@
+package debora
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+	Data migrations.
+	A release declares its migrations in .debora-migrations.json at the root of the repo.
+	They run after the new binary is installed and the old process has stopped,
+	before the app is started again, so they are run by the new debora.
+	Each migration has an id and runs once; debora records which have run
+	under the debora root. Before migrating, the paths the spec lists are snapshotted.
+	If a migration fails, the snapshot is restored and the app is restarted on its old binary.
+	Migrate directives run along with them, every time.
+*/
+
+// Migrations of a release, read from the root of its checkout
+const MigrationsFile = ".debora-migrations.json"
+
+// A migration step
+type Migration struct {
+	ID      string   // unique id. migrations with an id only run once
+	Command []string // run in the release's checkout, with the hook variables
+}
+
+// A release's migrations
+type MigrationSpec struct {
+	Snapshot   []string    // paths to snapshot before migrating. may use $HOME and hook variables
+	Migrations []Migration // run in order
+	Dir        string      `json:",omitempty"` // where to run them, set by debora
+}
+
+// A migration that has run
+type AppliedMigration struct {
+	ID     string
+	Commit string
+	At     int64 // unix time
+}
+
+func migrationsDir(app string) string {
+	return path.Join(DeboraRoot, "migrations", app)
+}
+
+// Read the migration spec from a checkout, if it has one
+func loadMigrations(dir string) (*MigrationSpec, error) {
+	b, err := ioutil.ReadFile(path.Join(dir, MigrationsFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	spec := new(MigrationSpec)
+	if err := json.Unmarshal(b, spec); err != nil {
+		return nil, fmt.Errorf("Bad %s: %s", MigrationsFile, err.Error())
+	}
+	for _, m := range spec.Migrations {
+		if len(m.Command) == 0 {
+			return nil, fmt.Errorf("Migration %s has no command", m.ID)
+		}
+	}
+	spec.Dir = dir
+	return spec, nil
+}
+
+// Migrations that have run for the app
+func AppliedMigrations(app string) ([]AppliedMigration, error) {
+	b, err := ioutil.ReadFile(path.Join(migrationsDir(app), "applied.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var applied []AppliedMigration
+	return applied, json.Unmarshal(b, &applied)
+}
+
+func writeApplied(app string, applied []AppliedMigration) error {
+	if err := os.MkdirAll(migrationsDir(app), 0700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(applied, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(migrationsDir(app), "applied.json"), b, 0600)
+}
+
+// Migrations in the spec that haven't run yet
+func pendingMigrations(app string, spec *MigrationSpec) ([]Migration, error) {
+	applied, err := AppliedMigrations(app)
+	if err != nil {
+		return nil, err
+	}
+	done := make(map[string]bool)
+	for _, a := range applied {
+		done[a.ID] = true
+	}
+	var pending []Migration
+	for _, m := range spec.Migrations {
+		if m.ID == "" || !done[m.ID] {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// Whether any migration in the spec may still run.
+// If we can't tell, assume so
+func hasPendingMigrations(app string, spec *MigrationSpec) bool {
+	if spec == nil {
+		return false
+	}
+	pending, err := pendingMigrations(app, spec)
+	return err != nil || len(pending) > 0
+}
+
+func runMigration(m Migration, dir string, env []string, out io.Writer) error {
+	cmd := exec.Command(m.Command[0], m.Command[1:]...)
+	cmd.Dir = dir
+	cmd.Env = append(append(os.Environ(), env...), "DEBORA_MIGRATION="+m.ID)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Migration %s (%s) failed: %s", m.ID, strings.Join(m.Command, " "), err.Error())
+	}
+	return nil
+}
+
+// Run the pending migrations of the spec, with the app stopped.
+// The snapshot paths are copied first and restored if a migration fails
+func (deb *Debora) migrate(spec *MigrationSpec, env HookEnv) error {
+	app := env.App
+	pending, err := pendingMigrations(app, spec)
+	if err != nil || len(pending) == 0 {
+		return err
+	}
+	env.Stage = "migrate"
+	env.Dir = spec.Dir
+
+	snap := path.Join(DeboraRoot, "snapshots", app, fmt.Sprint(time.Now().Unix()))
+	paths := expandAll(spec.Snapshot, env)
+	for i, p := range paths {
+		deb.Logf(fmt.Sprintf("Snapshotting %s\n", p))
+		if err := copyTree(p, path.Join(snap, fmt.Sprint(i))); err != nil && !os.IsNotExist(err) {
+			os.RemoveAll(snap)
+			return fmt.Errorf("error on snapshot %s", err.Error())
+		}
+	}
+	defer os.RemoveAll(snap)
+
+	applied, err := AppliedMigrations(app)
+	if err != nil {
+		return err
+	}
+	for _, m := range pending {
+		deb.Logf(fmt.Sprintf("Running migration %s\n", m.ID))
+		if err := runMigration(m, spec.Dir, env.Environ(), deb.logWriter()); err != nil {
+			deb.Logf(fmt.Sprintln(err))
+			deb.restoreSnapshot(snap, paths)
+			return err
+		}
+		if m.ID != "" {
+			applied = append(applied, AppliedMigration{ID: m.ID, Commit: env.NewCommit, At: time.Now().Unix()})
+		}
+	}
+	return writeApplied(app, applied)
+}
+
+// Put the snapshotted paths back
+func (deb *Debora) restoreSnapshot(snap string, paths []string) {
+	for i, p := range paths {
+		from := path.Join(snap, fmt.Sprint(i))
+		os.RemoveAll(p)
+		if _, err := os.Lstat(from); err != nil {
+			// it didn't exist before the migration
+			continue
+		}
+		if err := copyTree(from, p); err != nil {
+			deb.Logf(fmt.Sprintf("Error restoring %s: %s\n", p, err.Error()))
+			continue
+		}
+		deb.Logf(fmt.Sprintf("Restored %s\n", p))
+	}
+}
+
+// Copy a file or directory, keeping modes and symlinks
+func copyTree(from, to string) error {
+	return filepath.Walk(from, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(from, p)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(to, rel)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(dst, info.Mode().Perm()|0700)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, dst)
+		default:
+			if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+				return err
+			}
+			in, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+			out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, in); err != nil {
+				out.Close()
+				return err
+			}
+			return out.Close()
+		}
+	})
+}
+
+// List the migrations a checkout would run, without running them.
+// The app may be running, so nothing touches its data
+func DryRunMigrations(app, dir string, out io.Writer) error {
+	spec, err := loadMigrations(dir)
+	if err != nil {
+		return err
+	}
+	if spec == nil {
+		fmt.Fprintf(out, "No %s in %s\n", MigrationsFile, dir)
+		return nil
+	}
+	pending, err := pendingMigrations(app, spec)
+	if err != nil {
+		return err
+	}
+	for _, m := range pending {
+		fmt.Fprintf(out, "Migration %s: %s\n", m.ID, strings.Join(m.Command, " "))
+	}
+	fmt.Fprintf(out, "%d pending migrations\n", len(pending))
+	return nil
+}
@@ -0,0 +1,70 @@
+package debora
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+/*
+	Canary rollouts.
+	Each peer's debora has a random id, kept in the debora root dir.
+	An upgrade message may target a fraction of peers (Percent)
+	and list peer ids to always include or exclude.
+	Peers are picked by a hash of their id and the release,
+	so the same peers are picked every time, and widening
+	the rollout for a release only adds peers.
+*/
+
+// Get this peer's id, creating it if it doesn't exist
+func PeerID() (string, error) {
+	filename := path.Join(DeboraRoot, "peer_id")
+	b, err := ioutil.ReadFile(filename)
+	if err == nil {
+		return strings.TrimSpace(string(b)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	idHex := hex.EncodeToString(id)
+	if err := ioutil.WriteFile(filename, []byte(idHex), 0600); err != nil {
+		return "", err
+	}
+	return idHex, nil
+}
+
+// Should the peer apply this upgrade.
+// Excluded peers never do and included peers always do.
+// If Percent is set, peers are picked by hash,
+// otherwise only included peers are picked, or all peers if none are listed
+func inRollout(obj UpgradeMsg, peerID string) bool {
+	for _, id := range obj.Exclude {
+		if id == peerID {
+			return false
+		}
+	}
+	for _, id := range obj.Include {
+		if id == peerID {
+			return true
+		}
+	}
+	if obj.Percent <= 0 {
+		return len(obj.Include) == 0
+	}
+	return rolloutBucket(peerID, obj.Commit) < uint64(obj.Percent)
+}
+
+// Deterministic bucket in [0, 100) for the peer and release
+func rolloutBucket(peerID, release string) uint64 {
+	h := sha256.Sum256([]byte(peerID + ":" + release))
+	return binary.BigEndian.Uint64(h[:8]) % 100
+}
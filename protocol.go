@@ -0,0 +1,350 @@
+package debora
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+/*
+	Wire protocol.
+	Each daemon route has its own request (and response) type,
+	and so does the upgrade message broadcast by the developer.
+	Every message carries the protocol version. Versioned messages
+	are decoded strictly: unknown fields and invalid values are rejected
+	with an ErrorResponse body. Messages without a version are
+	from before the protocol was versioned, when one omnibus object
+	was used for everything. Field names haven't changed,
+	so they decode into the typed messages, ignoring fields they don't need.
+*/
+
+// Version of the wire protocol.
+// Version 2 added tunneled upgrades, version 3 the artifact's size,
+// and version 4 several hook commands per stage and callback hooks
+const ProtocolVersion = 4
+
+// A message with its own validation
+type message interface {
+	validate() error
+}
+
+// Body of an error response
+type ErrorResponse struct {
+	Version int
+	Error   string
+}
+
+// The upgrade message the developer broadcasts to peers
+type UpgradeMsg struct {
+	Version    int
+	Host       string      `json:",omitempty"` // developer's call server (ip:port)
+	Commit     string      `json:",omitempty"` // commit, tag, branch or version to upgrade to
+	Directives []Directive `json:",omitempty"` // steps of the upgrade, in order. defaults to upgrading the app to Commit
+
+	ActivateAt     int64 `json:",omitempty"` // unix time (UTC) at which to swap in the upgrade
+	ActivateHeight int64 `json:",omitempty"` // app height at which to swap in the upgrade
+
+	MaxDown int `json:",omitempty"` // max peers restarting at once. 0 means no coordination
+
+	Percent int      `json:",omitempty"` // percent of peers to upgrade, picked by hash of peer id and commit
+	Include []string `json:",omitempty"` // peer ids that always upgrade
+	Exclude []string `json:",omitempty"` // peer ids that never upgrade
+
+	Artifact *Artifact `json:",omitempty"` // prebuilt binary to install instead of building from source
+	Bundle   *Bundle   `json:",omitempty"` // git bundle to fetch from instead of origin
+
+	BinarySHA256 string `json:",omitempty"` // attested hash of the binary built reproducibly from Commit
+	Toolchain    string `json:",omitempty"` // go toolchain to build with, eg. go1.22.3
+
+	Tunnel bool `json:",omitempty"` // reach the developer through the app's p2p layer instead of dialing Host
+}
+
+func (m UpgradeMsg) validate() error {
+	if m.Commit == "" && len(m.Directives) == 0 {
+		return fmt.Errorf("Upgrade has no commit or directives")
+	}
+	if m.Percent < 0 || m.Percent > 100 {
+		return fmt.Errorf("Percent must be between 0 and 100")
+	}
+	if m.MaxDown < 0 || m.ActivateAt < 0 || m.ActivateHeight < 0 {
+		return fmt.Errorf("Negative upgrade limits")
+	}
+	return nil
+}
+
+// add: an app process registers with its debora
+type AddRequest struct {
+	Version int
+	Key     string     // hex encoded DER public key of the developer
+	Pid     int        // process id
+	Args    []string   // command line call that started the process
+	App     string     // app name
+	Src     string     `json:",omitempty"` // app's source, relative to $GOPATH/src or absolute
+	Pkg     string     `json:",omitempty"` // main package to install, relative to Src (eg. ./cmd/node)
+	Build   *BuildSpec `json:",omitempty"` // how to build the app, if not a plain `go install`
+	LogFile string     `json:",omitempty"` // file to write upgrade logs to
+
+	Hooks       HookCmds `json:",omitempty"` // lifecycle hook commands, by stage
+	HookFuncs   []string `json:",omitempty"` // stages the app runs go callbacks at
+	DirtyPolicy string   `json:",omitempty"` // what to do with local changes in a checkout upgraded in place
+	GoProxy     string   `json:",omitempty"` // GOPROXY to download dependencies from
+}
+
+func (m AddRequest) validate() error {
+	if m.Key == "" || m.App == "" || m.Pid <= 0 || len(m.Args) == 0 {
+		return fmt.Errorf("Add needs a key, app, pid and args")
+	}
+	return nil
+}
+
+// start: debora starts the app for the first time
+type StartRequest struct {
+	Version int
+	App     string
+	Args    []string
+}
+
+func (m StartRequest) validate() error {
+	if m.App == "" || len(m.Args) == 0 {
+		return fmt.Errorf("Start needs an app and args")
+	}
+	return nil
+}
+
+// restart: the old debora hands the app over to a new one,
+// who restarts it once it exits
+type RestartRequest struct {
+	Version int
+	App     string
+	Pid     int      // pid of the app to wait for
+	Args    []string // command line to restart the app with
+	Src     string   `json:",omitempty"`
+	Pkg     string   `json:",omitempty"`
+	LogFile string   `json:",omitempty"`
+
+	Hooks     HookCmds         `json:",omitempty"` // lifecycle hook commands, by stage
+	Commit    string           `json:",omitempty"` // commit the app restarts on
+	OldCommit string           `json:",omitempty"` // commit running before the upgrade
+	Host      string           `json:",omitempty"` // developer's call server, to report to
+	Lease     string           `json:",omitempty"` // restart lease granted by the developer
+	Token     string           `json:",omitempty"` // from the handshake with the developer
+	Timings   map[string]int64 `json:",omitempty"` // time spent in each stage of the upgrade so far, for the report
+
+	Migrations *MigrationSpec `json:",omitempty"` // migrations to run before restarting the app
+	Route      *TunnelRoute   `json:",omitempty"` // path to the developer, for tunneled upgrades
+}
+
+func (m RestartRequest) validate() error {
+	if m.App == "" || m.Pid <= 0 || len(m.Args) == 0 {
+		return fmt.Errorf("Restart needs an app, pid and args")
+	}
+	return nil
+}
+
+// The developer's call server, for a restarted app
+func (m RestartRequest) developer() devConn {
+	return devConn{host: m.Host, tunnel: m.Route, token: m.Token}
+}
+
+// call: the app hands debora an upgrade message it received
+type CallRequest struct {
+	UpgradeMsg
+	Pid   int          // pid of the calling app
+	Route *TunnelRoute `json:",omitempty"` // path to the developer, for tunneled upgrades
+}
+
+func (m CallRequest) validate() error {
+	if m.Pid <= 0 {
+		return fmt.Errorf("Call needs a pid")
+	}
+	if m.Host == "" {
+		return fmt.Errorf("Call needs the developer's host")
+	}
+	if m.Tunnel && m.Route == nil {
+		return fmt.Errorf("Tunneled call needs a route to the developer")
+	}
+	return m.UpgradeMsg.validate()
+}
+
+// known: is the process added to debora
+type KnownRequest struct {
+	Version int
+	Pid     int
+}
+
+func (m KnownRequest) validate() error {
+	if m.Pid <= 0 {
+		return fmt.Errorf("Known needs a pid")
+	}
+	return nil
+}
+
+// Response to known. Unknown processes get a 404
+type KnownResponse struct {
+	Version int
+	Known   bool
+}
+
+// height: the app reports its height
+type HeightRequest struct {
+	Version int
+	Pid     int
+	Height  int64
+}
+
+func (m HeightRequest) validate() error {
+	if m.Pid <= 0 || m.Height < 0 {
+		return fmt.Errorf("Height needs a pid and a height")
+	}
+	return nil
+}
+
+// rollback: switch the app back to a stored binary
+type RollbackRequest struct {
+	Version int
+	Commit  string `json:",omitempty"` // commit to roll back to. defaults to the previous binary
+}
+
+func (m RollbackRequest) validate() error {
+	return nil
+}
+
+// Response to rollback
+type RollbackResponse struct {
+	Version int
+	Commit  string // commit the app was rolled back to
+}
+
+// tunnel: the app picks up the daemon's requests to the developer,
+// and hands back their replies
+type TunnelPoll struct {
+	Version int
+	Pid     int
+	Replies []TunnelMsg `json:",omitempty"`
+}
+
+func (m TunnelPoll) validate() error {
+	if m.Pid <= 0 {
+		return fmt.Errorf("Tunnel needs a pid")
+	}
+	return nil
+}
+
+// Response to tunnel
+type TunnelPollResponse struct {
+	Version  int
+	Requests []TunnelMsg `json:",omitempty"` // requests to send to the developer
+}
+
+// hook: the app picks up the stages to run its callbacks at,
+// and hands back their results
+type HookPoll struct {
+	Version int
+	Pid     int
+	Result  *HookResult `json:",omitempty"` // of the last stage the app picked up
+}
+
+func (m HookPoll) validate() error {
+	if m.Pid <= 0 {
+		return fmt.Errorf("Hook needs a pid")
+	}
+	return nil
+}
+
+// A stage for the app to run its callbacks at
+type HookCall struct {
+	ID  string // random id, matching the result to the call
+	Env HookEnv
+}
+
+// The result of the app's callbacks for a stage
+type HookResult struct {
+	ID    string
+	Error string `json:",omitempty"` // a callback failed
+}
+
+// Response to hook
+type HookPollResponse struct {
+	Version int
+	Call    *HookCall `json:",omitempty"`
+}
+
+// Hook commands, by stage
+type HookCmds map[string][][]string
+
+// Before protocol version 4, each stage had a single command.
+// Both shapes decode, so old and new daemons and apps can hand over to each other
+func (h *HookCmds) UnmarshalJSON(b []byte) error {
+	var cmds map[string][][]string
+	if err := json.Unmarshal(b, &cmds); err == nil {
+		*h = cmds
+		return nil
+	}
+	var old map[string][]string
+	if err := json.Unmarshal(b, &old); err != nil {
+		return err
+	}
+	*h = make(HookCmds)
+	for stage, args := range old {
+		(*h)[stage] = [][]string{args}
+	}
+	return nil
+}
+
+// Decode a message, accepting messages from before the protocol was versioned
+func decodeMsg(p []byte, msg message) error {
+	var v struct{ Version int }
+	if err := json.Unmarshal(p, &v); err != nil {
+		return err
+	}
+	switch {
+	case v.Version > ProtocolVersion:
+		return fmt.Errorf("Unsupported protocol version %d", v.Version)
+	case v.Version == 0:
+		// the old omnibus object
+		if err := json.Unmarshal(p, msg); err != nil {
+			return err
+		}
+	default:
+		dec := json.NewDecoder(bytes.NewReader(p))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(msg); err != nil {
+			return err
+		}
+	}
+	return msg.validate()
+}
+
+// Read and decode a request's body, writing an error response if it's bad
+func readMsg(w http.ResponseWriter, r *http.Request, msg message) bool {
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(r.Body); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return false
+	}
+	if err := decodeMsg(buf.Bytes(), msg); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return false
+	}
+	return true
+}
+
+// Write a structured error response
+func writeError(w http.ResponseWriter, status int, err error) {
+	b, _ := json.Marshal(ErrorResponse{Version: ProtocolVersion, Error: err.Error()})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// Write a response message
+func writeMsg(w http.ResponseWriter, msg interface{}) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
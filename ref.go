@@ -0,0 +1,210 @@
+package debora
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+	Release references.
+	An upgrade may name a commit hash, a tag (annotated or not), a branch,
+	or a semantic version constraint like "^1.4" or ">=1.4.2 <2".
+	References are resolved to a commit on the peer, after fetching,
+	and the resolved commit is what gets checked out, logged and reported.
+	A constraint picks the highest tagged version satisfying it.
+*/
+
+// Characters allowed in a reference, besides letters and digits
+const refChars = "._-/^~<>=!*+, "
+
+// Check a reference is safe to hand to git
+func validRef(ref string) error {
+	if strings.TrimSpace(ref) == "" {
+		return fmt.Errorf("Empty reference")
+	}
+	if strings.HasPrefix(ref, "-") || strings.Contains(ref, "..") {
+		return fmt.Errorf("Invalid reference: %s", ref)
+	}
+	for _, c := range ref {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune(refChars, c)) {
+			return fmt.Errorf("Invalid character %q in reference: %s", c, ref)
+		}
+	}
+	return nil
+}
+
+// Whether the reference is a full commit hash (sha1 or sha256)
+func IsCommitHash(ref string) bool {
+	if len(ref) != 40 && len(ref) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(ref)
+	return err == nil && strings.ToLower(ref) == ref
+}
+
+// Resolve a reference to a full commit hash in src's repo.
+// The repo must have been fetched
+func (deb *Debora) resolveRef(src, ref string) (string, error) {
+	if err := validRef(ref); err != nil {
+		return "", err
+	}
+	if isConstraint(ref) {
+		tag, err := deb.matchTag(src, ref)
+		if err != nil {
+			return "", err
+		}
+		deb.Logf(fmt.Sprintf("Version %s matches %s\n", tag, ref))
+		ref = "refs/tags/" + tag
+	}
+	// prefer the remote's branch over a stale local one
+	candidates := []string{"refs/remotes/origin/" + ref, ref}
+	if strings.HasPrefix(ref, "refs/") {
+		candidates = candidates[1:]
+	}
+	for _, c := range candidates {
+		out, err := deb.git(src, "rev-parse", "--verify", "--quiet", c+"^{commit}")
+		if err == nil {
+			commit := strings.TrimSpace(out)
+			if commit != ref {
+				deb.Logf(fmt.Sprintf("Resolved %s to commit %s\n", ref, commit))
+			}
+			return commit, nil
+		}
+	}
+	return "", fmt.Errorf("Unknown reference %s", ref)
+}
+
+// The highest tagged version satisfying the constraint
+func (deb *Debora) matchTag(src, constraint string) (string, error) {
+	out, err := deb.git(src, "tag", "--list")
+	if err != nil {
+		return "", err
+	}
+	var best string
+	var bestV semver
+	for _, tag := range strings.Fields(out) {
+		v, ok := parseSemver(tag)
+		if !ok || !v.satisfies(constraint) {
+			continue
+		}
+		if best == "" || v.compare(bestV) > 0 {
+			best, bestV = tag, v
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("No tagged version satisfies %s", constraint)
+	}
+	return best, nil
+}
+
+// A semantic version, eg. v1.4.2 or 1.5.0-rc1
+type semver struct {
+	major, minor, patch int
+	pre                 string
+}
+
+// Whether the reference is a version constraint rather than a name
+func isConstraint(ref string) bool {
+	return strings.ContainsAny(ref[:1], "^~<>=!*") || strings.ContainsAny(ref, " ,")
+}
+
+// Parse a version. Missing minor or patch numbers are zero
+func parseSemver(s string) (semver, bool) {
+	var v semver
+	s = strings.TrimPrefix(s, "v")
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		s = s[:i]
+	}
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		v.pre = s[i+1:]
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return v, false
+	}
+	nums := []*int{&v.major, &v.minor, &v.patch}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return v, false
+		}
+		*nums[i] = n
+	}
+	return v, true
+}
+
+func (v semver) compare(o semver) int {
+	for _, d := range []int{v.major - o.major, v.minor - o.minor, v.patch - o.patch} {
+		if d != 0 {
+			return d
+		}
+	}
+	// a pre-release is lower than its release
+	switch {
+	case v.pre == o.pre:
+		return 0
+	case v.pre == "":
+		return 1
+	case o.pre == "":
+		return -1
+	}
+	return strings.Compare(v.pre, o.pre)
+}
+
+// Check v against a constraint: comparisons separated by spaces or commas,
+// all of which must hold. eg. ">=1.4.2 <2", "^1.4", "~1.4.2", "=1.4.2".
+// Pre-releases only match a constraint naming them exactly
+func (v semver) satisfies(constraint string) bool {
+	terms := strings.FieldsFunc(constraint, func(r rune) bool { return r == ' ' || r == ',' })
+	if len(terms) == 0 {
+		return false
+	}
+	for _, t := range terms {
+		if t == "*" {
+			if v.pre != "" {
+				return false
+			}
+			continue
+		}
+		rest := strings.TrimLeft(t, "<>=!^~")
+		op := t[:len(t)-len(rest)]
+		want, ok := parseSemver(rest)
+		if !ok {
+			return false
+		}
+		if v.pre != "" && (op != "=" && op != "" || want.pre != v.pre) {
+			return false
+		}
+		c := v.compare(want)
+		var holds bool
+		switch op {
+		case "", "=":
+			holds = c == 0
+		case "!=":
+			holds = c != 0
+		case ">":
+			holds = c > 0
+		case ">=":
+			holds = c >= 0
+		case "<":
+			holds = c < 0
+		case "<=":
+			holds = c <= 0
+		case "^":
+			// same major version, or minor for 0.x
+			holds = c >= 0 && v.major == want.major && (want.major > 0 || v.minor == want.minor)
+		case "~":
+			// same minor version
+			holds = c >= 0 && v.major == want.major && v.minor == want.minor
+		default:
+			return false
+		}
+		if !holds {
+			return false
+		}
+	}
+	return true
+}
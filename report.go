@@ -0,0 +1,194 @@
+package debora
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"time"
+)
+
+/*
+	Upgrade outcome reporting.
+	Each peer's debora reports the stage its upgrade has reached
+	to the developer's call server, along with any error and how long each stage took.
+	`debora call` shows the reports as they come in.
+	Reports carry the token from the handshake, so the developer only
+	takes them from authenticated peers, and each token reports for one peer.
+	Stages reached before the handshake are reported with the first stage after it.
+*/
+
+// Stages of an upgrade, as reported to the developer
+const (
+	StageReceived      = "received"      // upgrade message received
+	StageSkipped       = "skipped"       // peer not in the rollout, or already on the commit
+	StageAuthenticated = "authenticated" // handshake with developer succeeded
+	StageDownload      = "download"      // downloading a prebuilt artifact
+	StageFetch         = "fetch"         // fetching and checking out the commit
+	StageDeps          = "deps"          // downloading and verifying module dependencies
+	StageInstall       = "install"       // building the new binary
+	StageStaged        = "staged"        // built, waiting for activation
+	StageLease         = "lease"         // waiting for a restart lease
+	StageRestart       = "restart"       // app is being restarted
+	StageMigrate       = "migrate"       // running data migrations, with the app stopped
+	StageStarted       = "started"       // app is back up on the new commit
+)
+
+// Outcome of an upgrade on one peer
+type Report struct {
+	PeerID  string
+	App     string
+	Commit  string
+	Stage   string           // last stage reached
+	Error   string           `json:",omitempty"`
+	Done    bool             // the upgrade is over, successfully or not
+	Timings map[string]int64 `json:",omitempty"` // milliseconds spent in each stage
+}
+
+// Did the upgrade fail
+func (r Report) Failed() bool {
+	return r.Error != ""
+}
+
+// Sends the reports for an upgrade in progress
+// to the developer's call server
+type reporter struct {
+	dev    devConn
+	report Report
+	start  time.Time // start of the current stage
+}
+
+func newReporter(dev devConn, app, commit string) *reporter {
+	peerID, err := PeerID()
+	if err != nil {
+		logger.Println("Error getting peer id:", err)
+	}
+	return &reporter{
+		dev: dev,
+		report: Report{
+			PeerID:  peerID,
+			App:     app,
+			Commit:  commit,
+			Timings: make(map[string]int64),
+		},
+	}
+}
+
+// Move on to the next stage and report it
+func (r *reporter) stage(stage string) {
+	if r == nil {
+		return
+	}
+	r.enter(stage)
+	r.send()
+}
+
+// The upgrade is over
+func (r *reporter) done(stage string) {
+	if r == nil {
+		return
+	}
+	r.enter(stage)
+	r.report.Done = true
+	r.send()
+}
+
+// The upgrade failed in the current stage
+func (r *reporter) fail(err error) {
+	if r == nil {
+		return
+	}
+	r.enter(r.report.Stage)
+	r.report.Error = err.Error()
+	r.report.Done = true
+	r.send()
+}
+
+// record how long the current stage took and start the next
+func (r *reporter) enter(stage string) {
+	now := time.Now()
+	if r.report.Stage != "" {
+		r.report.Timings[r.report.Stage] += int64(now.Sub(r.start) / time.Millisecond)
+	}
+	r.report.Stage = stage
+	r.start = now
+}
+
+// Body of a report request
+type reportRequest struct {
+	Token string // from the handshake
+	Report
+}
+
+func (r *reporter) send() {
+	// not authenticated yet
+	if r.dev.token == "" {
+		return
+	}
+	b, err := json.Marshal(reportRequest{Token: r.dev.token, Report: r.report})
+	if err != nil {
+		logger.Println("Error encoding report:", err)
+		return
+	}
+	if err := r.dev.notify("report", b); err != nil {
+		logger.Println("Error sending report to developer:", err)
+	}
+}
+
+/*
+	Developer side call daemon routes
+*/
+
+// A peer reports the progress of its upgrade
+func (deb *DeveloperDebora) reportHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var req reportRequest
+	if err := json.Unmarshal(p, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	report := req.Report
+	if report.PeerID == "" {
+		http.Error(w, "Report is missing the peer id", http.StatusBadRequest)
+		return
+	}
+	deb.mtx.Lock()
+	peerID, ok := deb.tokens[req.Token]
+	if !ok || req.Token == "" {
+		deb.mtx.Unlock()
+		http.Error(w, "Unknown token. Handshake first", http.StatusUnauthorized)
+		return
+	}
+	if peerID != "" && peerID != report.PeerID {
+		deb.mtx.Unlock()
+		http.Error(w, fmt.Sprintf("Token belongs to peer %s", peerID), http.StatusForbidden)
+		return
+	}
+	deb.tokens[req.Token] = report.PeerID
+	deb.reports[report.PeerID] = report
+	deb.mtx.Unlock()
+	deb.touch()
+}
+
+// Latest report from every peer, sorted by peer id
+func (deb *DeveloperDebora) Reports() []Report {
+	deb.mtx.Lock()
+	defer deb.mtx.Unlock()
+	reports := make([]Report, 0, len(deb.reports))
+	for _, r := range deb.reports {
+		reports = append(reports, r)
+	}
+	sort.Sort(reportsByPeer(reports))
+	return reports
+}
+
+type reportsByPeer []Report
+
+func (r reportsByPeer) Len() int           { return len(r) }
+func (r reportsByPeer) Less(i, j int) bool { return r[i].PeerID < r[j].PeerID }
+func (r reportsByPeer) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
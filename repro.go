@@ -0,0 +1,34 @@
+package debora
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+)
+
+/*
+	Reproducible build verification.
+	The developer may attest to the sha256 of the binary built from a commit.
+	Peers then build with ReproducibleFlags, and the toolchain pinned in the message,
+	and refuse to activate a binary whose hash differs.
+	To compute the hash, the developer builds with the same flags and toolchain,
+	eg. `GOTOOLCHAIN=go1.22.3 go build -trimpath -buildvcs=false`.
+*/
+
+// Build flags for reproducible binaries
+var ReproducibleFlags = []string{"-trimpath", "-buildvcs=false"}
+
+// sha256 of a file, hex encoded
+func fileSHA256(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
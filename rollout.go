@@ -0,0 +1,105 @@
+package debora
+
+import (
+	"time"
+)
+
+/*
+	Completion of a rollout on the developer's side.
+	`debora call` waits on the call server until enough peers are done,
+	a timeout passes, or the peers go quiet, and then summarizes the reports.
+*/
+
+// When to stop waiting on peers. Zero values are ignored
+type CallCriteria struct {
+	Peers   int           // number of peers that reported being done or staged
+	Timeout time.Duration // total time to wait
+	Quiet   time.Duration // time without new handshakes or reports
+}
+
+// Outcome of a rollout
+type Summary struct {
+	Handshakes int // peers that authenticated with us
+	Succeeded  int // peers that restarted on the new commit
+	Failed     int // peers that reported an error
+	Skipped    int // peers not in the rollout
+	Staged     int // peers built and waiting for a scheduled activation
+	Unfinished int // peers still upgrading when we stopped, including those yet to report
+	TimedOut   bool
+	Reports    []Report
+}
+
+// Number of peers that did not complete the upgrade
+func (s Summary) Failures() int {
+	return s.Failed + s.Unfinished
+}
+
+// Record activity from a peer, for the quiet period
+func (deb *DeveloperDebora) touch() {
+	deb.mtx.Lock()
+	deb.lastSeen = time.Now()
+	deb.mtx.Unlock()
+}
+
+// Summarize the rollout so far
+func (deb *DeveloperDebora) Summary() Summary {
+	reports := deb.Reports()
+	deb.mtx.Lock()
+	s := Summary{
+		Handshakes: deb.handshakes,
+		Reports:    reports,
+	}
+	// tokens are bound to a peer by its first report
+	for _, peer := range deb.tokens {
+		if peer == "" {
+			s.Unfinished++
+		}
+	}
+	deb.mtx.Unlock()
+	for _, r := range reports {
+		switch {
+		case r.Failed():
+			s.Failed++
+		case r.Stage == StageStaged:
+			s.Staged++
+		case !r.Done:
+			s.Unfinished++
+		case r.Stage == StageSkipped:
+			s.Skipped++
+		default:
+			s.Succeeded++
+		}
+	}
+	return s
+}
+
+// Block until the criteria are met and summarize the rollout.
+// Peers count once they've reported being done or staged,
+// and we always wait on peers still upgrading,
+// including those that authenticated but haven't reported yet.
+// With no criteria, this blocks forever
+func (deb *DeveloperDebora) Wait(c CallCriteria) Summary {
+	start := time.Now()
+	deb.touch()
+	for {
+		time.Sleep(100 * time.Millisecond)
+		s := deb.Summary()
+
+		if c.Timeout > 0 && time.Since(start) > c.Timeout {
+			s.TimedOut = true
+			return s
+		}
+
+		deb.mtx.Lock()
+		lastSeen := deb.lastSeen
+		deb.mtx.Unlock()
+		if c.Quiet > 0 && time.Since(lastSeen) > c.Quiet {
+			return s
+		}
+
+		done := s.Succeeded + s.Failed + s.Skipped + s.Staged
+		if c.Peers > 0 && done >= c.Peers && s.Unfinished == 0 {
+			return s
+		}
+	}
+}
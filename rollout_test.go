@@ -0,0 +1,41 @@
+package debora
+
+import (
+	"testing"
+	"time"
+)
+
+// A peer that authenticated but hasn't reported yet is still upgrading
+func TestWaitForUnreportedPeers(t *testing.T) {
+	deb := NewDeveloperDebora("", 0)
+	deb.handshakes = 2
+	deb.tokens["a"] = "peer-a"
+	deb.tokens["b"] = ""
+	deb.reports["peer-a"] = Report{PeerID: "peer-a", Stage: StageStarted, Done: true}
+
+	s := deb.Summary()
+	if s.Succeeded != 1 || s.Unfinished != 1 {
+		t.Fatalf("expected one succeeded and one unfinished peer, got %+v", s)
+	}
+
+	done := make(chan Summary, 1)
+	go func() { done <- deb.Wait(CallCriteria{Peers: 1}) }()
+	select {
+	case s := <-done:
+		t.Fatalf("returned before the second peer reported: %+v", s)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	deb.mtx.Lock()
+	deb.tokens["b"] = "peer-b"
+	deb.reports["peer-b"] = Report{PeerID: "peer-b", Stage: StageStarted, Done: true}
+	deb.mtx.Unlock()
+	select {
+	case s := <-done:
+		if s.Succeeded != 2 || s.Unfinished != 0 {
+			t.Fatalf("bad summary %+v", s)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("still waiting after every peer reported")
+	}
+}
@@ -1,8 +1,6 @@
 package debora
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -10,7 +8,6 @@ import (
 	"os"
 	"os/exec"
 	"path"
-	"strings"
 	"time"
 )
 
@@ -28,6 +25,8 @@ import (
 	- add: add an app process to the local debora
 	- call: take down, upgrade, and restart calling process
 	- known: is this app known to debora
+	- height: the app reports its current height
+	- status: report the app and any pending upgrade
 */
 
 // Check if debora server is running
@@ -41,20 +40,12 @@ func (deb *Debora) kill(w http.ResponseWriter, r *http.Request) {
 }
 
 func (deb *Debora) start(w http.ResponseWriter, r *http.Request) {
-	// read the request, unmarshal json
-	p, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
-	var reqObj = RequestObj{}
-	err = json.Unmarshal(p, &reqObj)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// read the request
+	var reqObj StartRequest
+	if !readMsg(w, r, &reqObj) {
+		return
 	}
 
-	if len(reqObj.Args) == 0 {
-		http.Error(w, "Bad Request", http.StatusInternalServerError)
-	}
 	args := reqObj.Args
 	prgm := args[0]
 	if len(args) > 1 {
@@ -69,33 +60,42 @@ func (deb *Debora) start(w http.ResponseWriter, r *http.Request) {
 	cmd.Stderr = os.Stderr
 
 	if err := cmd.Start(); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err)
 	}
 }
 
 func (deb *Debora) restart(w http.ResponseWriter, r *http.Request) {
-	// read the request, unmarshal json
-	p, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// read the request
+	var reqObj RestartRequest
+	if !readMsg(w, r, &reqObj) {
 		return
 	}
-	var reqObj = RequestObj{}
-	err = json.Unmarshal(p, &reqObj)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+	fmt.Printf(".%d\n", reqObj.Pid)
+	if _, err := CheckValidProcess(reqObj.Pid); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("Cannot find process id %d", reqObj.Pid))
 		return
 	}
 
-	if len(reqObj.Args) == 0 {
-		http.Error(w, "Bad Request", http.StatusInternalServerError)
-		return
+	// log the migrations to the app's upgrade log, until it adds itself
+	if deb.deb.LogFile == "" {
+		deb.deb.LogFile = reqObj.LogFile
 	}
 
-	fmt.Printf(".%d\n", reqObj.Pid)
-	_, err = CheckValidProcess(reqObj.Pid)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Cannot find process id %d", reqObj.Pid), http.StatusInternalServerError)
+	// the old debora hands the upgrade over to us.
+	// it is finished once the app has added itself again
+	var rep *reporter
+	if reqObj.Host != "" {
+		rep = newReporter(reqObj.developer(), reqObj.App, reqObj.Commit)
+		// carry on with the old debora's timings
+		for stage, ms := range reqObj.Timings {
+			rep.report.Timings[stage] = ms
+		}
+		rep.enter(StageRestart)
+		deb.mtx.Lock()
+		deb.upgraded = &reqObj
+		deb.rep = rep
+		deb.mtx.Unlock()
 	}
 
 	// spin up a goroutine to watch the pid.
@@ -111,6 +111,11 @@ func (deb *Debora) restart(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
+		// migrate the app's data while it's down
+		if reqObj.Migrations != nil {
+			deb.migrateOrRollBack(&reqObj, rep)
+		}
+
 		// restart process
 		prgm := reqObj.Args[0]
 		var args []string
@@ -126,10 +131,21 @@ func (deb *Debora) restart(w http.ResponseWriter, r *http.Request) {
 		cmd.Stderr = os.Stderr
 		if err := cmd.Start(); err != nil {
 			deb.Logf(fmt.Sprintln("Restart error:", err))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
 		deb.Logln("Process successfully restarted")
+
+		// the old debora hands us the upgrade info
+		// so we can run the post-start hooks
+		env := HookEnv{
+			App:       reqObj.App,
+			Stage:     HookPostStart,
+			Src:       srcPath(reqObj.Src),
+			OldCommit: reqObj.OldCommit,
+			NewCommit: reqObj.Commit,
+		}
+		deb.runHooks(reqObj.Hooks, env)
 	}()
 
 	// this function returning without error
@@ -139,21 +155,16 @@ func (deb *Debora) restart(w http.ResponseWriter, r *http.Request) {
 
 // Add a new process to debora
 func (deb *Debora) add(w http.ResponseWriter, r *http.Request) {
-	// read the request, unmarshal json
-	p, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
-	var reqObj = RequestObj{}
-	err = json.Unmarshal(p, &reqObj)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// read the request
+	var reqObj AddRequest
+	if !readMsg(w, r, &reqObj) {
+		return
 	}
 
 	// check if process is real
 	pid := reqObj.Pid
-	if _, err = CheckValidProcess(pid); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if _, err := CheckValidProcess(pid); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -165,90 +176,556 @@ func (deb *Debora) add(w http.ResponseWriter, r *http.Request) {
 	if _, err := os.Stat(deb.LogFile()); err != nil {
 		os.Create(deb.LogFile())
 	}
+
+	// the restarted app is up and has added itself,
+	// so give back our restart lease, report success,
+	// and have it run its post-start callbacks
+	deb.mtx.Lock()
+	upgraded, rep := deb.upgraded, deb.rep
+	deb.upgraded, deb.rep = nil, nil
+	deb.mtx.Unlock()
+	if upgraded != nil {
+		go func() {
+			if upgraded.Lease != "" {
+				if err := releaseLease(upgraded.developer(), upgraded.Lease); err != nil {
+					deb.Logf(fmt.Sprintln("Error releasing restart lease:", err))
+				}
+			}
+			rep.done(StageStarted)
+		}()
+		// the app picks up the stage once it polls for it
+		go func() {
+			env := HookEnv{
+				App:       upgraded.App,
+				Stage:     HookPostStart,
+				Src:       srcPath(upgraded.Src),
+				OldCommit: upgraded.OldCommit,
+				NewCommit: upgraded.Commit,
+			}
+			if err := deb.callHookFuncs(env); err != nil {
+				deb.Logf(fmt.Sprintf("Hook %s failed: %s\n", HookPostStart, err.Error()))
+			}
+		}()
+	}
 }
 
 // Find out if a process is known to debora
 func (deb *Debora) known(w http.ResponseWriter, r *http.Request) {
-	// read the request, unmarshal json
-	p, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// read the request
+	var reqObj KnownRequest
+	if !readMsg(w, r, &reqObj) {
+		return
 	}
-	var reqObj = RequestObj{}
-	err = json.Unmarshal(p, &reqObj)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if deb.deb.Pid != reqObj.Pid {
+		writeError(w, http.StatusNotFound, fmt.Errorf("Unknown process id %d", reqObj.Pid))
+		return
 	}
-	if deb.deb.Pid == reqObj.Pid {
-		// this need only be not nil or len 0
-		w.Write([]byte("ok"))
+	writeMsg(w, KnownResponse{Version: ProtocolVersion, Known: true})
+}
+
+// The app reports its height, for scheduled upgrades
+func (deb *Debora) heightReport(w http.ResponseWriter, r *http.Request) {
+	// read the request
+	var reqObj HeightRequest
+	if !readMsg(w, r, &reqObj) {
+		return
+	}
+	if deb.deb.Pid != reqObj.Pid {
+		writeError(w, http.StatusNotFound, fmt.Errorf("Unknown process id %d", reqObj.Pid))
+		return
 	}
+	deb.mtx.Lock()
+	deb.height = reqObj.Height
+	deb.heightAt = time.Now()
+	deb.mtx.Unlock()
 }
 
-// Call debora to take down a process, upgrade it, and restart
-func (deb *Debora) call(w http.ResponseWriter, r *http.Request) {
-	// read the request, unmarshal json
-	p, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+// The app picks up requests to tunnel to the developer,
+// and hands back their replies
+func (deb *Debora) tunnel(w http.ResponseWriter, r *http.Request) {
+	var reqObj TunnelPoll
+	if !readMsg(w, r, &reqObj) {
+		return
+	}
+	if deb.deb.Pid != reqObj.Pid {
+		writeError(w, http.StatusNotFound, fmt.Errorf("Unknown process id %d", reqObj.Pid))
+		return
+	}
+	// replies are handed back right away, by whoever received them,
+	// so the requests are left for the app's poll
+	if len(reqObj.Replies) > 0 {
+		tunnelReplies(reqObj.Replies)
+		writeMsg(w, TunnelPollResponse{Version: ProtocolVersion})
+		return
+	}
+	writeMsg(w, TunnelPollResponse{Version: ProtocolVersion, Requests: tunnelRequests()})
+}
+
+// The app hands back the result of its callbacks,
+// and picks up the next stage to run them at
+func (deb *Debora) hook(w http.ResponseWriter, r *http.Request) {
+	var reqObj HookPoll
+	if !readMsg(w, r, &reqObj) {
 		return
 	}
-	var reqObj = RequestObj{}
-	err = json.Unmarshal(p, &reqObj)
+	if deb.deb.Pid != reqObj.Pid {
+		writeError(w, http.StatusNotFound, fmt.Errorf("Unknown process id %d", reqObj.Pid))
+		return
+	}
+	if reqObj.Result != nil {
+		hookResult(*reqObj.Result)
+	}
+	writeMsg(w, HookPollResponse{Version: ProtocolVersion, Call: hookCallFor()})
+}
+
+// Report the app and any pending upgrade
+func (deb *Debora) status(w http.ResponseWriter, r *http.Request) {
+	peerID, err := PeerID()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	deb.mtx.Lock()
+	status := Status{
+		Version: ProtocolVersion,
+		PeerID:  peerID,
+		App:     deb.deb.App,
+		Pid:     deb.deb.Pid,
+		Commit:  runningCommit(deb.deb.App),
+		Height:  deb.height,
+		Pending: deb.pending,
+	}
+	deb.mtx.Unlock()
+	writeMsg(w, status)
+}
+
+// Call debora to take down a process, upgrade it, and restart
+func (deb *Debora) call(w http.ResponseWriter, r *http.Request) {
+	// read the request
+	var callReq CallRequest
+	if !readMsg(w, r, &callReq) {
 		return
 	}
+	reqObj := callReq.UpgradeMsg
 
 	// our local debora info
 	obj := deb.deb
 
 	// check if process is real
-	var proc *os.Process
-	if proc, err = CheckValidProcess(reqObj.Pid); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	pid := callReq.Pid
+	proc, err := CheckValidProcess(pid)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	pid := reqObj.Pid
 	if obj.Pid != pid {
-		http.Error(w, fmt.Sprintf("Unknown process id %d", pid), http.StatusInternalServerError)
+		writeError(w, http.StatusNotFound, fmt.Errorf("Unknown process id %d", pid))
 		return
 	}
 	key := obj.Key
 
-	// handshake with developer
-	host := reqObj.Host
-	logger.Println("ready to handshake with", host)
-	ok, err := handshake(key, host)
-	logger.Println("handshake:", ok, err)
+	// report our progress to the developer
+	dev := devConn{host: reqObj.Host}
+	if reqObj.Tunnel {
+		dev.tunnel = callReq.Route
+	}
+	rep := newReporter(dev, obj.App, reqObj.Commit)
+	rep.stage(StageReceived)
+
+	// handshake with developer.
+	// only authenticated peers may report, so do it first
+	logger.Println("ready to handshake with", dev.host)
+	token, err := handshake(key, dev)
+	logger.Println("handshake:", token != "", err)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		rep.fail(err)
+		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	if !ok {
+	if token == "" {
 		// TODO: respond signal from invalid dev
 		logger.Println("Signal from invalid developer")
+		rep.fail(fmt.Errorf("Signal from invalid developer"))
+		return
+	}
+	// the token authorizes our later requests
+	dev.token = token
+	rep.dev = dev
+	rep.stage(StageAuthenticated)
+
+	// reject bad directives before fetching anything
+	ds, err := directives(reqObj)
+	if err != nil {
+		deb.Logf(fmt.Sprintln("Bad upgrade:", err))
+		rep.fail(err)
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// ignore the upgrade if this peer is not part of the rollout.
+	// a later call may widen it
+	peerID := rep.report.PeerID
+	if !inRollout(reqObj, peerID) {
+		deb.Logf(fmt.Sprintf("Peer %s is not in the rollout of %s. Ignoring the upgrade\n", peerID, reqObj.Commit))
+		rep.done(StageSkipped)
 		return
 	}
 
 	// anything after this point until the restart ought to
 	// be logged to file
-	commitHash := reqObj.Commit
 	deb.Logf(fmt.Sprintf("The signal from %s is authentic\n", "DEV"))
-	deb.Logf(fmt.Sprintf("Upgrading the binary to commit %s\n", commitHash))
+	for _, d := range ds {
+		deb.Logf(fmt.Sprintf("Upgrade directive: %s\n", d))
+	}
+
+	objSrc := srcPath(obj.Src)
+	oldCommit := runningCommit(obj.App)
+	if oldCommit == "" {
+		oldCommit, err = gitHead(objSrc)
+		if err != nil {
+			deb.Logf(fmt.Sprintln("Could not read current commit:", err))
+		}
+	}
+	env := HookEnv{
+		App:       obj.App,
+		Src:       objSrc,
+		OldCommit: oldCommit,
+		NewCommit: oldCommit,
+	}
+	if c := appCommit(ds); c != "" {
+		env.NewCommit = c
+	}
+	// a relayed or repeated message may ask for the commit we already run
+	if alreadyRunning(ds, oldCommit) {
+		deb.Logf(fmt.Sprintf("Already running %s. Ignoring the upgrade\n", oldCommit))
+		rep.done(StageSkipped)
+		return
+	}
+	// if the upgrade is scheduled, build it now
+	// and wait for the activation condition in the background
+	if hasActivation(reqObj) {
+		if err := deb.schedule(proc, env, reqObj, rep); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	if err := deb.upgrade(proc, env, reqObj, rep); err != nil {
+		deb.fail(env, rep, err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	deb.exit()
+}
+
+// The upgrade failed. Report it and run the failure hooks
+func (deb *Debora) fail(env HookEnv, rep *reporter, err error) {
+	rep.fail(err)
+	env.Stage = HookOnFailure
+	deb.runHooks(deb.deb.Hooks, env)
+}
+
+// The app has been handed over to a new debora
+func (deb *Debora) exit() {
+	// TODO: poll new debora
+
+	logger.Println("This debora process has been replaced by a new one")
+	logger.Println("Goodbye!")
+	os.Exit(0)
+}
+
+// Build the upgrade into the staging directory right away,
+// and activate it in the background once the condition is met
+func (deb *Debora) schedule(proc *os.Process, env HookEnv, reqObj UpgradeMsg, rep *reporter) error {
+	deb.mtx.Lock()
+	if deb.pending != nil {
+		deb.mtx.Unlock()
+		return fmt.Errorf("An upgrade to %s is already pending", deb.pending.Commit)
+	}
+	// the height would never be reached
+	if reqObj.ActivateHeight > 0 && deb.heightAt.IsZero() {
+		deb.mtx.Unlock()
+		return fmt.Errorf("The app doesn't report its height. Was it added with AddWithHeight?")
+	}
+	deb.pending = &reqObj
+	deb.mtx.Unlock()
+
+	// undo the directives and drop the staged upgrade,
+	// so another can be scheduled
+	app := deb.deb.App
+	undo := func() {}
+	abort := func(err error) {
+		undo()
+		os.RemoveAll(stagingDir(app))
+		deb.fail(env, rep, err)
+		deb.mtx.Lock()
+		deb.pending = nil
+		deb.mtx.Unlock()
+	}
+	var err error
+	if undo, err = deb.prepare(&env, reqObj, stagingDir(app), rep); err != nil {
+		abort(err)
+		return err
+	}
+	deb.Logf(fmt.Sprintf("Upgrade to %s is staged. Activating at %s\n", env.NewCommit, activationString(reqObj)))
+	rep.stage(StageStaged)
+
+	go func() {
+		deb.waitActivation(reqObj)
+		deb.Logln("Activating the staged upgrade")
+		if err := deb.activate(proc, env, reqObj, rep); err != nil {
+			deb.Logf(fmt.Sprintln("Activation error:", err))
+			abort(err)
+			return
+		}
+		deb.exit()
+	}()
+	return nil
+}
+
+// Run the upgrade pipeline for the app:
+// stage everything the directives need,
+// then activate it and hand the process over to a new debora.
+// reqObj is the upgrade message from the developer
+func (deb *Debora) upgrade(proc *os.Process, env HookEnv, reqObj UpgradeMsg, rep *reporter) error {
+	app := deb.deb.App
+	undo, err := deb.prepare(&env, reqObj, stagingDir(app), rep)
+	if err != nil {
+		os.RemoveAll(stagingDir(app))
+		return err
+	}
+	if err := deb.activate(proc, env, reqObj, rep); err != nil {
+		// put back everything the directives changed
+		undo()
+		os.RemoveAll(stagingDir(app))
+		return err
+	}
+	return nil
+}
+
+// Run the directives' fetches and builds in order, installing into gobin.
+// If any fails, those before it are undone.
+// Otherwise, returns a function undoing them all, for when the activation fails.
+// env is updated with where the commit was built
+func (deb *Debora) prepare(env *HookEnv, reqObj UpgradeMsg, gobin string, rep *reporter) (func(), error) {
+	var undos []func()
+	undo := func() {
+		for i := len(undos) - 1; i >= 0; i-- {
+			undos[i]()
+		}
+	}
+
+	hooks := deb.deb.Hooks
+	env.Stage = HookPreFetch
+	if err := deb.runHooks(hooks, *env); err != nil {
+		return undo, fmt.Errorf("error on %s hook %s", HookPreFetch, err.Error())
+	}
+
+	ds, err := directives(reqObj)
+	if err != nil {
+		return undo, err
+	}
+	for _, d := range ds {
+		switch d.Op {
+		case DirectiveUpgradeApp:
+			err = deb.prepareApp(env, reqObj, gobin, rep)
+		case DirectiveUpgradeDebora:
+			var u func()
+			// puts debora's checkout back
+			u, err = deb.prepareDebora(d.Commit, gobin, rep)
+			if u != nil {
+				undos = append(undos, u)
+			}
+		}
+		if err != nil {
+			undo()
+			return func() {}, err
+		}
+	}
+	return undo, nil
+}
+
+// Fetch, build and install the app's new commit into gobin
+func (deb *Debora) prepareApp(env *HookEnv, reqObj UpgradeMsg, gobin string, rep *reporter) error {
+	hooks := deb.deb.Hooks
+	hook := func(stage string) error {
+		env.Stage = stage
+		return deb.runHooks(hooks, *env)
+	}
+
+	// install the prebuilt binary if there is one,
+	// otherwise fall back to building from source
+	if a := reqObj.Artifact; a != nil {
+		rep.stage(StageDownload)
+		commit, err := deb.artifactCommit(env.Src, env.NewCommit)
+		if err == nil {
+			err = deb.installArtifact(a, reqObj.Commit, gobin)
+		}
+		if err == nil {
+			// the binary is stored and recorded under the resolved commit
+			env.NewCommit = commit
+			env.Binary = a.Name
+			hook(HookPostInstall)
+			return nil
+		}
+		deb.Logf(fmt.Sprintf("Artifact error: %s. Building from source\n", err.Error()))
+	}
 
 	// fetch and checkout the updates
-	objSrc := path.Join(GoSrc, obj.Src)
-	if err := deb.upgradeCall(objSrc, commitHash); err != nil {
+	rep.stage(StageFetch)
+	dir, err := deb.upgradeCall(env.App, env.Src, env.NewCommit, reqObj.Bundle)
+	if err != nil {
 		deb.Logf(fmt.Sprintln("Upgrade error:", err))
-		http.Error(w, fmt.Sprintf("error on upgrade %s", err.Error()), http.StatusInternalServerError)
-		return
+		return fmt.Errorf("error on upgrade %s", err.Error())
 	}
+	env.Dir = dir
+	// the worktree is named by the resolved commit
+	env.NewCommit = path.Base(dir)
+	hook(HookPostCheckout)
+
+	// get the dependencies
+	rep.stage(StageDeps)
+	if err := deb.downloadDeps(dir); err != nil {
+		deb.Logf(fmt.Sprintln("Dependency error:", err))
+		return fmt.Errorf("error on dependencies %s", err.Error())
+	}
+
 	// upgrade the binary
-	if err := deb.installRepo(objSrc); err != nil {
-		deb.Logf(fmt.Sprintln("Tnstall error:", err))
-		http.Error(w, fmt.Sprintf("error on repo install %s", err.Error()), http.StatusInternalServerError)
-		return
+	rep.stage(StageInstall)
+	bin, err := deb.buildApp(dir, gobin, *env, reqObj)
+	if err != nil {
+		deb.Logf(fmt.Sprintln("Install error:", err))
+		return fmt.Errorf("error on repo install %s", err.Error())
+	}
+	env.Binary = bin
+	hook(HookPostInstall)
+
+	// catch a bad migration spec before anything is swapped in
+	if _, err := loadMigrations(dir); err != nil {
+		return err
+	}
+
+	// clean up old worktrees, keeping the running one and the new one
+	deb.gcWorktrees(env.App, env.Src, dir, path.Join(worktreesDir(env.App), env.OldCommit))
+	return nil
+}
+
+// Upgrade debora's checkout in place and install her into gobin.
+// Returns a function putting the checkout back
+func (deb *Debora) prepareDebora(hash, gobin string, rep *reporter) (func(), error) {
+	rep.stage(StageFetch)
+	old, err := gitHead(DeboraCmdPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := deb.upgradeRepo(DeboraCmdPath, hash, deb.deb.DirtyPolicy); err != nil {
+		return nil, fmt.Errorf("error on debora upgrade %s", err.Error())
+	}
+	undo := func() {
+		deb.Logf(fmt.Sprintf("Putting debora back at %s\n", old))
+		deb.git(DeboraCmdPath, "checkout", old)
+	}
+	rep.stage(StageDeps)
+	if err := deb.downloadDeps(DeboraCmdPath); err != nil {
+		undo()
+		return nil, fmt.Errorf("error on debora dependencies %s", err.Error())
+	}
+	rep.stage(StageInstall)
+	if err := deb.installRepo(DeboraCmdPath, "", gobin); err != nil {
+		undo()
+		return nil, fmt.Errorf("error on debora install %s", err.Error())
+	}
+	return undo, nil
+}
+
+// Swap in the staged binaries,
+// then stop the app and hand it over to a new debora,
+// who restarts it on the new binary.
+// If the developer limits how many peers restart at once,
+// wait for a restart lease first
+func (deb *Debora) activate(proc *os.Process, env HookEnv, reqObj UpgradeMsg, rep *reporter) error {
+	obj := deb.deb
+	next := deb.restartRequest(env)
+	dev := rep.dev
+	next.Host = dev.host
+	next.Route = dev.tunnel
+	next.Token = dev.token
+	if reqObj.MaxDown > 0 {
+		deb.Logln("Waiting for a restart lease")
+		rep.stage(StageLease)
+		lease, err := acquireLease(dev)
+		if err != nil {
+			return fmt.Errorf("error on restart lease %s", err.Error())
+		}
+		next.Lease = lease
+	}
+	release := func() {
+		if next.Lease != "" {
+			releaseLease(dev, next.Lease)
+		}
+	}
+
+	// the new debora runs the migrations once the app has stopped
+	ds, err := directives(reqObj)
+	if err != nil {
+		release()
+		return err
+	}
+	if next.Migrations, err = migrationsFor(ds, env); err != nil {
+		release()
+		return err
+	}
+
+	// swap in the staged binaries
+	restore, err := activateStaged(obj.App)
+	if err != nil {
+		restore()
+		release()
+		return fmt.Errorf("error activating the upgrade %s", err.Error())
+	}
+	for _, d := range ds {
+		if d.Op == DirectiveSetArgs {
+			next.Args = append(next.Args[:1:1], d.Args...)
+			deb.Logf(fmt.Sprintln("Restarting with args", d.Args))
+		}
+	}
+
+	rep.stage(StageRestart)
+	next.Timings = rep.report.Timings
+	if err := deb.handover(proc, env, next); err != nil {
+		restore()
+		release()
+		return err
+	}
+	os.RemoveAll(replacedDir(obj.App))
+	return nil
+}
+
+// The app's info for the new debora, to restart it on env.NewCommit
+func (deb *Debora) restartRequest(env HookEnv) RestartRequest {
+	obj := deb.deb
+	return RestartRequest{
+		Version:   ProtocolVersion,
+		App:       obj.App,
+		Pid:       obj.Pid,
+		Args:      obj.Args,
+		Src:       obj.Src,
+		Pkg:       obj.Pkg,
+		LogFile:   obj.LogFile,
+		Hooks:     obj.Hooks,
+		Commit:    env.NewCommit,
+		OldCommit: env.OldCommit,
+	}
+}
+
+// Hand the app over to a new debora, who restarts it.
+// next is the app's info for the new debora,
+// with the developer's host so she can finish the upgrade
+func (deb *Debora) handover(proc *os.Process, env HookEnv, next RestartRequest) error {
+	obj := deb.deb
+	env.Stage = HookPreStop
+	if err := deb.runHooks(obj.Hooks, env); err != nil {
+		return fmt.Errorf("error on %s hook %s", HookPreStop, err.Error())
 	}
 
 	// The app (and possibly debora herself) have been upgraded
@@ -259,11 +736,46 @@ func (deb *Debora) call(w http.ResponseWriter, r *http.Request) {
 
 	// start the new debora process
 	// and give it the pid of the app that's being reset.
-	// blocks until the new process is up
+	// blocks until the new process is up.
+	// she runs the post-start hooks once the app is back
+	// keep the new binary in the store, and launch the app through its symlink
+	prev, _ := currentBinary(obj.App)
+	if env.Binary != "" {
+		// migrations can only be undone by restarting on the old binary
+		err := deb.storeReplaced(obj.App, env.OldCommit, path.Join(replacedDir(obj.App), env.Binary))
+		if err != nil && hasPendingMigrations(obj.App, next.Migrations) {
+			return fmt.Errorf("refusing to migrate with no binary to roll back to: %s", err.Error())
+		} else if err != nil {
+			deb.Logf(fmt.Sprintln("Not storing the replaced binary:", err))
+		}
+		args, err := deb.storeAndLink(obj.App, env.NewCommit, path.Join(GoBin, env.Binary), next.Args)
+		if err != nil {
+			return fmt.Errorf("error storing binary %s", err.Error())
+		}
+		next.Args = args
+	}
+
 	fmt.Println("STARTING NEW DEBORA")
-	if err := startDebora(obj.App, obj.Args, obj.Pid); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	if err := startDebora(next, obj.Pid); err != nil {
+		// the app keeps running the old binary
+		if env.Binary != "" && prev != "" {
+			linkBinary(obj.App, StoredBinary{Path: prev})
+		}
+		return err
+	}
+
+	// remember which commit the app now runs:
+	// the worktree it runs from, or the artifact's
+	running := ""
+	if env.Dir != "" && env.Dir != env.Src {
+		running = path.Base(env.Dir)
+	} else if env.Dir == "" && env.Binary != "" {
+		running = env.NewCommit
+	}
+	if running != "" {
+		if err := writeRunningCommit(obj.App, running); err != nil {
+			deb.Logf(fmt.Sprintln("Error recording the running commit:", err))
+		}
 	}
 
 	// if startDebora returned successfully,
@@ -271,122 +783,64 @@ func (deb *Debora) call(w http.ResponseWriter, r *http.Request) {
 	// let's kill it, and let new debora restart it.
 	deb.Logln("Terminating the process")
 	// terminate the process
-	err = proc.Signal(os.Interrupt)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	// TODO: poll new debora
-
-	logger.Println("This debora process has been replaced by a new one")
-	logger.Println("Goodbye!")
-	os.Exit(0)
+	return proc.Signal(os.Interrupt)
 }
 
-// expects the full path to the source directory and a valid hash.
-// change to that directory
-// exits if the directory is dirty.
+// expects the full path to the source directory and a valid reference.
 // git fetch -a origin
+// deal with local changes according to the dirty tree policy
 // git checkout hash
-func (deb *Debora) upgradeRepo(src, hash string) error {
-	cur, err := os.Getwd()
+func (deb *Debora) upgradeRepo(src, hash, policy string) error {
+	// fetch all remote updates
+	out, err := deb.git(src, "fetch", "-a", "--tags", "origin")
 	if err != nil {
-		return err // this one is annoying ..
-	}
-	if err := os.Chdir(src); err != nil {
-		return fmt.Errorf("Bad directory: %s", src)
+		return err
 	}
-	defer os.Chdir(cur)
+	deb.Logf(out)
 
-	// if the directory is dirty, abort upgrade
-	cmd := exec.Command("git", "diff-files", "--quiet")
-	if err := cmd.Run(); err != nil {
-		errStr := "Working tree is dirty. Aborting upgrade."
-		deb.Logln(errStr)
-		return fmt.Errorf(errStr)
+	commit, err := deb.resolveRef(src, hash)
+	if err != nil {
+		return err
 	}
 
-	// fetch all remote updates
-	buf := new(bytes.Buffer)
-	cmd = exec.Command("git", "fetch", "-a", "origin")
-	cmd.Stdout = buf
-	cmd.Stderr = buf
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("Git fetch error: %s", err.Error())
+	stashed, err := deb.cleanTree(src, policy)
+	if err != nil {
+		return err
 	}
-	deb.Logf(string(buf.Bytes()))
 
 	// chceckout the provided hash
-	buf = new(bytes.Buffer)
-	cmd = exec.Command("git", "checkout", hash)
-	cmd.Stdout = buf
-	cmd.Stderr = buf
-	if err := cmd.Run(); err != nil {
-		deb.Logf(string(buf.Bytes()))
-		return fmt.Errorf("Git checkout error: %s", err.Error())
+	if _, err := deb.git(src, "checkout", commit); err != nil {
+		if stashed {
+			deb.Logln("Local changes remain in the stash")
+		}
+		return err
+	}
+	if stashed {
+		deb.restoreStash(src)
 	}
 	return nil
 }
 
 // src should be the full path
-// upgradeCall will either upgrade the dir at objSrc or
-// upgrade and install debora, depending on `hash`
-func (deb *Debora) upgradeCall(src, hash string) error {
-
-	// the hash may contain more information
-	// if its just a hash, go to src, fetch, and checkout hash
-	// else we its "debora_upgrade:hash", and we should upgrade
-	// debora
-	spl := strings.Split(hash, ":")
-	switch len(spl) {
-	case 1:
-		if !isHex(hash) {
-			return fmt.Errorf("Provided hash is not valid hex: %s", hash)
-		}
-		// its just a hash, git fetch and checkout
-		return deb.upgradeRepo(src, hash)
-	case 2:
-		// its a directive and a hash
-		cmd := spl[0]
-		hash := spl[1]
-		if !isHex(hash) {
-			return fmt.Errorf("Provided hash is not valid hex: %s", hash)
-		}
-		// for now the only other thing we do is upgrade debora
-		// and rebuild the app
-		_ = cmd
-		err := deb.upgradeRepo(DeboraCmdPath, hash)
-		if err != nil {
-			return err
-		}
-		return deb.installRepo(DeboraCmdPath)
-	default:
-		return fmt.Errorf("Unknown upgrade directive: %s", hash)
-	}
+// upgradeCall checks out the commit from the repo at src in its own worktree.
+// If there is a bundle, the commits are fetched from it instead of origin.
+// Returns the directory to build the app from
+func (deb *Debora) upgradeCall(app, src, hash string, bundle *Bundle) (string, error) {
+	if err := validRef(hash); err != nil {
+		return "", err
+	}
+	return deb.upgradeWorktree(app, src, hash, bundle)
 }
 
 // src is a full path
-// cd to src, `go install`
-func (deb *Debora) installRepo(src string) error {
-	cur, err := os.Getwd()
-	if err != nil {
-		return err // this one is annoying ..
-	}
-	if err := os.Chdir(src); err != nil {
+// `go install pkg` from src, pkg defaulting to src itself.
+// If gobin is not empty, the binary is installed there
+func (deb *Debora) installRepo(src, pkg, gobin string) error {
+	if _, err := os.Stat(src); err != nil {
 		return fmt.Errorf("Bad directory: %s", src)
 	}
-	defer os.Chdir(cur)
 
-	buf := new(bytes.Buffer)
-	cmd := exec.Command("go", "install")
-	cmd.Stdout = buf
-	cmd.Stderr = buf
-	if err := cmd.Run(); err != nil {
-		return err
-	}
-	deb.Logf(string(buf.Bytes()))
-	return nil
+	return goInstall(src, pkg, gobin, deb.logWriter(), deb.moduleEnv(src))
 }
 
 /*
@@ -402,10 +856,11 @@ func (deb *DebMaster) call(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	// peers of a tunneled upgrade reach the call server through us
+	setTunnelHost(payload)
 	logger.Println("Issuing broadcast")
 	// broadcast the upgrade message to all the peers
-	// the payload is json encoded RequestObj
-	// but probably only the Host field is filled in
+	// the payload is a json encoded UpgradeMsg
 	deb.callFunc(payload)
 }
 
@@ -433,4 +888,109 @@ func (deb *DeveloperDebora) handshake(w http.ResponseWriter, r *http.Request) {
 	// we sign it with itself
 	mac := SignMAC(plainText, plainText)
 	w.Write(mac)
+
+	deb.mtx.Lock()
+	deb.handshakes++
+	deb.tokens[handshakeToken(plainText)] = ""
+	deb.mtx.Unlock()
+	deb.touch()
+}
+
+// Switch the app back to a binary in the store and restart it
+// through the normal handover. With no commit,
+// roll back to the binary installed before the current one
+func (deb *Debora) rollback(w http.ResponseWriter, r *http.Request) {
+	var reqObj RollbackRequest
+	if !readMsg(w, r, &reqObj) {
+		return
+	}
+
+	obj := deb.deb
+	proc, err := CheckValidProcess(obj.Pid)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	b, err := findStoredBinary(obj.App, reqObj.Commit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	deb.Logf(fmt.Sprintf("Rolling back to %s (installed %s)\n", b.Commit, time.Unix(b.Installed, 0).UTC().Format(time.RFC3339)))
+	if err := linkBinary(obj.App, b); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	env := HookEnv{
+		App:       obj.App,
+		Src:       srcPath(obj.Src),
+		OldCommit: runningCommit(obj.App),
+		NewCommit: b.Commit,
+	}
+	next := deb.restartRequest(env)
+	next.Args = linkArgs(obj.App, obj.Args)
+	if err := deb.handover(proc, env, next); err != nil {
+		deb.fail(env, nil, err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := writeRunningCommit(obj.App, b.Commit); err != nil {
+		deb.Logf(fmt.Sprintln("Error recording the running commit:", err))
+	}
+
+	// let the caller know before we go
+	writeMsg(w, RollbackResponse{Version: ProtocolVersion, Commit: b.Commit})
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	deb.exit()
+}
+
+// Run the migrations handed over with the app.
+// If one fails, give up on the upgrade and point the app's symlink
+// back at the old binary, so it restarts on the data it knows
+func (deb *Debora) migrateOrRollBack(reqObj *RestartRequest, rep *reporter) {
+	env := HookEnv{
+		App:       reqObj.App,
+		Src:       srcPath(reqObj.Src),
+		OldCommit: reqObj.OldCommit,
+		NewCommit: reqObj.Commit,
+	}
+	rep.stage(StageMigrate)
+	err := deb.migrate(reqObj.Migrations, env)
+	if err == nil {
+		return
+	}
+
+	// the upgrade is over
+	deb.mtx.Lock()
+	deb.upgraded, deb.rep = nil, nil
+	deb.mtx.Unlock()
+	if reqObj.Lease != "" {
+		releaseLease(reqObj.developer(), reqObj.Lease)
+	}
+	rep.fail(err)
+	env.Stage = HookOnFailure
+	deb.runHooks(reqObj.Hooks, env)
+
+	if reqObj.OldCommit == "" {
+		deb.Logln("No old commit to roll back to. Restarting on the new binary")
+		return
+	}
+	b, err := findStoredBinary(reqObj.App, reqObj.OldCommit)
+	if err != nil {
+		deb.Logln("No stored binary to roll back to. Restarting on the new binary")
+		return
+	}
+	if err := linkBinary(reqObj.App, b); err != nil {
+		deb.Logf(fmt.Sprintln("Error rolling back:", err))
+		return
+	}
+	reqObj.Args = linkArgs(reqObj.App, reqObj.Args)
+	reqObj.Commit = b.Commit
+	if err := writeRunningCommit(reqObj.App, b.Commit); err != nil {
+		deb.Logf(fmt.Sprintln("Error recording the running commit:", err))
+	}
+	deb.Logf(fmt.Sprintf("Rolled back to %s\n", b.Commit))
 }
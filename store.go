@@ -0,0 +1,205 @@
+package debora
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+	Versioned binary store.
+	Every binary debora installs for an app is also kept under the debora root,
+	with its commit and install time, and the app is launched through
+	a stable symlink pointing at the current one.
+	The last StoreRetention binaries are kept, so `debora rollback`
+	can switch back to any of them.
+*/
+
+// Number of binaries kept for each app
+var StoreRetention = 5
+
+// A binary in the store
+type StoredBinary struct {
+	Commit    string
+	Name      string
+	Installed int64  // unix time
+	Path      string `json:"-"`
+}
+
+func storeDir(app string) string {
+	return path.Join(DeboraRoot, "store", app)
+}
+
+// The stable symlink the app is launched through
+func BinaryLink(app string) string {
+	return path.Join(DeboraRoot, "bin", app)
+}
+
+func storeKey(commit string) string {
+	return strings.Replace(path.Base(commit), ":", "_", -1)
+}
+
+// Copy the binary at file, installed at the given time, into the store
+func storeBinary(app, commit, file string, installed time.Time) (StoredBinary, error) {
+	dir := path.Join(storeDir(app), storeKey(commit))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return StoredBinary{}, err
+	}
+	b := StoredBinary{
+		Commit:    commit,
+		Name:      path.Base(file),
+		Installed: installed.Unix(),
+		Path:      path.Join(dir, path.Base(file)),
+	}
+	if err := installFile(file, b.Path); err != nil {
+		return StoredBinary{}, err
+	}
+	meta, err := json.Marshal(b)
+	if err != nil {
+		return StoredBinary{}, err
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "meta.json"), meta, 0600); err != nil {
+		return StoredBinary{}, err
+	}
+	return b, nil
+}
+
+// Binaries in the store, newest first
+func StoredBinaries(app string) ([]StoredBinary, error) {
+	dirs, err := ioutil.ReadDir(storeDir(app))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var list []StoredBinary
+	for _, d := range dirs {
+		dir := path.Join(storeDir(app), d.Name())
+		meta, err := ioutil.ReadFile(path.Join(dir, "meta.json"))
+		if err != nil {
+			continue
+		}
+		var b StoredBinary
+		if err := json.Unmarshal(meta, &b); err != nil {
+			continue
+		}
+		b.Path = path.Join(dir, b.Name)
+		list = append(list, b)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Installed > list[j].Installed
+	})
+	return list, nil
+}
+
+// Point the app's symlink at the binary.
+// The new link is renamed over the old one, so it's never missing
+func linkBinary(app string, b StoredBinary) error {
+	link := BinaryLink(app)
+	if err := os.MkdirAll(path.Dir(link), 0700); err != nil {
+		return err
+	}
+	tmp := link + ".debora-tmp"
+	os.Remove(tmp)
+	if err := os.Symlink(b.Path, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, link)
+}
+
+// The binary the app's symlink points at
+func currentBinary(app string) (string, error) {
+	return os.Readlink(BinaryLink(app))
+}
+
+// Find a binary in the store by commit (or commit prefix).
+// With no commit, find the one installed before the current one
+func findStoredBinary(app, commit string) (StoredBinary, error) {
+	list, err := StoredBinaries(app)
+	if err != nil {
+		return StoredBinary{}, err
+	}
+	if commit != "" {
+		for _, b := range list {
+			if strings.HasPrefix(b.Commit, commit) {
+				return b, nil
+			}
+		}
+		return StoredBinary{}, fmt.Errorf("No stored binary for commit %s", commit)
+	}
+	cur, _ := currentBinary(app)
+	for i, b := range list {
+		if b.Path == cur && i+1 < len(list) {
+			return list[i+1], nil
+		}
+	}
+	return StoredBinary{}, fmt.Errorf("No previous binary to roll back to")
+}
+
+// Remove all but the newest StoreRetention binaries,
+// never removing the current one
+func gcStore(app string) {
+	list, err := StoredBinaries(app)
+	if err != nil {
+		return
+	}
+	cur, _ := currentBinary(app)
+	for i, b := range list {
+		if i < StoreRetention || b.Path == cur {
+			continue
+		}
+		os.RemoveAll(path.Dir(b.Path))
+	}
+}
+
+// Store the newly installed binary and switch the app's symlink to it.
+// Returns the app's args, launching it through the symlink
+func (deb *Debora) storeAndLink(app, commit, file string, args []string) ([]string, error) {
+	b, err := storeBinary(app, commit, file, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if err := linkBinary(app, b); err != nil {
+		return nil, err
+	}
+	gcStore(app)
+	deb.Logf(fmt.Sprintf("Stored %s at %s\n", b.Name, b.Path))
+	return linkArgs(app, args), nil
+}
+
+// Keep the binary the app ran before its first upgrade through the store,
+// so a failed migration has something to roll back to.
+// file is where the activation moved it. Binaries already stored are left alone
+func (deb *Debora) storeReplaced(app, commit, file string) error {
+	if commit == "" {
+		return fmt.Errorf("No old commit to store the binary under")
+	}
+	if _, err := findStoredBinary(app, commit); err == nil {
+		return nil
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	// it was installed before the new binary, and sorts after it
+	b, err := storeBinary(app, commit, file, info.ModTime())
+	if err != nil {
+		return err
+	}
+	deb.Logf(fmt.Sprintf("Stored the replaced %s at %s\n", b.Name, b.Path))
+	return nil
+}
+
+// Replace the program in args with the app's symlink
+func linkArgs(app string, args []string) []string {
+	out := []string{BinaryLink(app)}
+	if len(args) > 1 {
+		out = append(out, args[1:]...)
+	}
+	return out
+}
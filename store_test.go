@@ -0,0 +1,61 @@
+package debora
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// On the first upgrade through the store, the replaced binary is kept
+// under the old commit, so a failed migration can roll back to it
+func TestStoreReplaced(t *testing.T) {
+	oldRoot := DeboraRoot
+	DeboraRoot = t.TempDir()
+	defer func() { DeboraRoot = oldRoot }()
+	deb := &Debora{deb: AddRequest{App: "app"}}
+
+	dir := t.TempDir()
+	old, next := path.Join(dir, "old", "node"), path.Join(dir, "node")
+	os.MkdirAll(path.Dir(old), 0700)
+	for _, f := range []string{old, next} {
+		if err := ioutil.WriteFile(f, []byte(f), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// installed with the previous release
+	then := time.Now().Add(-time.Hour)
+	os.Chtimes(old, then, then)
+
+	if err := deb.storeReplaced("app", "aaaa", old); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := deb.storeAndLink("app", "bbbb", next, []string{next}); err != nil {
+		t.Fatal(err)
+	}
+	// it's the one installed before the new binary
+	b, err := findStoredBinary("app", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Commit != "aaaa" {
+		t.Fatalf("expected to roll back to aaaa, got %s", b.Commit)
+	}
+	if data, _ := ioutil.ReadFile(b.Path); string(data) != old {
+		t.Fatalf("stored %q for the old commit", data)
+	}
+
+	// later upgrades find it stored already
+	os.Remove(old)
+	if err := deb.storeReplaced("app", "aaaa", old); err != nil {
+		t.Fatal(err)
+	}
+	// with nothing to store, there's nothing to roll back to
+	if err := deb.storeReplaced("app", "cccc", old); err == nil {
+		t.Fatal("stored a missing binary")
+	}
+	if err := deb.storeReplaced("app", "", next); err == nil {
+		t.Fatal("stored a binary with no commit")
+	}
+}
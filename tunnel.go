@@ -0,0 +1,310 @@
+package debora
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+	Tunneling the developer's call server through the app's p2p layer.
+	Normally each peer's debora dials the developer's call server at the message's Host,
+	so the developer must expose a port every peer can reach.
+	With `debora call --tunnel`, the daemon never dials the developer.
+	Its requests (the handshake, reports and restart leases) are picked up by the app,
+	which long-polls the daemon for them, and sent over the app's p2p layer
+	to the peer the upgrade message came from. Relaying peers pass them on
+	the way the gossip came, until they reach the developer's app, which forwards
+	them to its local call server and sends the reply back along the same path.
+	The app gives debora a function to send to a peer with SetTunnelSender before Add,
+	and hands her the messages it receives with HandleTunnelMessage,
+	on the developer's peer too. Reports and lease releases are best effort.
+*/
+
+var (
+	TunnelTimeout     = 1 * time.Minute  // give up on a reply from the developer after this long
+	TunnelPollTimeout = 20 * time.Second // how long the app's poll waits for requests
+)
+
+// Tunnel messages
+const (
+	TunnelMsgRequest = "request" // a request to the developer's call server
+	TunnelMsgReply   = "reply"   // the call server's reply
+)
+
+// Routes of the developer's call server that may be tunneled
+var tunnelRoutes = map[string]bool{"handshake": true, "lease": true, "release": true, "report": true}
+
+// The path from a peer's debora to the developer, through the app's p2p layer
+type TunnelRoute struct {
+	Peer   string // peer the upgrade message came from
+	Gossip string `json:",omitempty"` // id of the gossip envelope, if the message was relayed
+}
+
+// A request to the developer's call server, or its reply
+type TunnelMsg struct {
+	Type   string
+	ID     string // random id, matching the reply to the request
+	Route  string `json:",omitempty"` // call server route of a request
+	Body   []byte `json:",omitempty"`
+	Error  string `json:",omitempty"` // the request failed
+	Gossip string `json:",omitempty"` // gossip envelope the request follows back to the developer
+	Peer   string `json:",omitempty"` // from the daemon to the app: the peer to send the request to
+}
+
+// A path back to the peer a relayed request came from
+type tunnelHop struct {
+	peer string
+	at   time.Time
+}
+
+var (
+	// sends a message to a peer.
+	// set by the app
+	tunnelSend func(peer string, msg []byte)
+
+	// the daemon's requests, waiting for the app to poll
+	tunnelOut = make(chan TunnelMsg, 64)
+
+	tunnelMtx     sync.Mutex
+	tunnelWaiting = make(map[string]chan TunnelMsg) // the daemon's requests waiting for a reply, by id
+	tunnelFrom    = make(map[string]tunnelHop)      // relayed requests, by id
+	tunnelDevHost string                            // call server of a tunneled upgrade, on the developer's peer
+)
+
+// Set the function debora uses to send tunnel messages to a peer.
+// Must be called before Add
+func SetTunnelSender(send func(peer string, msg []byte)) {
+	tunnelSend = send
+}
+
+// The developer's call server, dialed at host or reached through the tunnel
+type devConn struct {
+	host   string
+	tunnel *TunnelRoute
+	token  string // from the handshake, authorizing our other requests
+}
+
+// Send a request to the developer's call server and return the reply
+func (d devConn) request(route string, body []byte) ([]byte, error) {
+	if d.tunnel == nil {
+		return RequestResponse(d.host, route, body)
+	}
+	return tunnelRequest(d.tunnel, route, body, true)
+}
+
+// Send a request to the developer's call server.
+// Through the tunnel, the reply isn't waited for
+func (d devConn) notify(route string, body []byte) error {
+	if d.tunnel == nil {
+		_, err := RequestResponse(d.host, route, body)
+		return err
+	}
+	_, err := tunnelRequest(d.tunnel, route, body, false)
+	return err
+}
+
+// Queue a request for the app to tunnel, and wait for the reply if asked to.
+// Runs in the daemon
+func tunnelRequest(t *TunnelRoute, route string, body []byte, wait bool) ([]byte, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	msg := TunnelMsg{
+		Type:   TunnelMsgRequest,
+		ID:     hex.EncodeToString(id),
+		Route:  route,
+		Body:   body,
+		Gossip: t.Gossip,
+		Peer:   t.Peer,
+	}
+	var ch chan TunnelMsg
+	if wait {
+		ch = make(chan TunnelMsg, 1)
+		tunnelMtx.Lock()
+		tunnelWaiting[msg.ID] = ch
+		tunnelMtx.Unlock()
+		defer func() {
+			tunnelMtx.Lock()
+			delete(tunnelWaiting, msg.ID)
+			tunnelMtx.Unlock()
+		}()
+	}
+	select {
+	case tunnelOut <- msg:
+	default:
+		return nil, fmt.Errorf("Tunnel queue is full. Is the app polling?")
+	}
+	if !wait {
+		return nil, nil
+	}
+	select {
+	case reply := <-ch:
+		if reply.Error != "" {
+			return nil, fmt.Errorf("%s: %s", route, reply.Error)
+		}
+		return reply.Body, nil
+	case <-time.After(TunnelTimeout):
+		return nil, fmt.Errorf("No reply to %s from the developer through the tunnel", route)
+	}
+}
+
+// Hand the replies to the requests waiting for them.
+// Runs in the daemon
+func tunnelReplies(replies []TunnelMsg) {
+	tunnelMtx.Lock()
+	defer tunnelMtx.Unlock()
+	for _, reply := range replies {
+		if ch, ok := tunnelWaiting[reply.ID]; ok {
+			select {
+			case ch <- reply:
+			default:
+				// already answered
+			}
+		}
+	}
+}
+
+// Wait up to the poll timeout for requests,
+// and take all that are queued.
+// Runs in the daemon
+func tunnelRequests() []TunnelMsg {
+	var msgs []TunnelMsg
+	select {
+	case msg := <-tunnelOut:
+		msgs = append(msgs, msg)
+	case <-time.After(TunnelPollTimeout):
+		return nil
+	}
+	for {
+		select {
+		case msg := <-tunnelOut:
+			msgs = append(msgs, msg)
+		default:
+			return msgs
+		}
+	}
+}
+
+// Pick up the daemon's requests to the developer and send them on.
+// Runs in the app process
+func pollTunnel(c *Client, pid int) {
+	for {
+		resp, err := c.Tunnel(context.Background(), TunnelPoll{Pid: pid})
+		if err != nil {
+			logger.Println("Error polling debora for tunnel requests:", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		for _, msg := range resp.Requests {
+			peer := msg.Peer
+			msg.Peer = ""
+			sendTunnelMsg(peer, msg)
+		}
+	}
+}
+
+func sendTunnelMsg(peer string, msg TunnelMsg) {
+	if tunnelSend == nil {
+		return
+	}
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	tunnelSend(peer, b)
+}
+
+// Remember the call server of a tunneled upgrade we broadcast,
+// so we can forward the peers' requests to it.
+// Runs in the developer's app process
+func setTunnelHost(payload []byte) {
+	var m UpgradeMsg
+	var err error
+	if isGossip(payload) {
+		var g Gossip
+		if g, err = decodeGossip(payload); err == nil {
+			m, err = DecodeUpgrade(g.Payload)
+		}
+	} else {
+		m, err = decodeUpgrade(payload)
+	}
+	if err != nil || !m.Tunnel {
+		return
+	}
+	tunnelMtx.Lock()
+	tunnelDevHost = m.Host
+	tunnelMtx.Unlock()
+}
+
+// Pass a request on to the developer's call server and return its reply
+func forwardTunnel(host string, msg TunnelMsg) TunnelMsg {
+	reply := TunnelMsg{Type: TunnelMsgReply, ID: msg.ID}
+	if !tunnelRoutes[msg.Route] {
+		reply.Error = fmt.Sprintf("Route %q can't be tunneled", msg.Route)
+		return reply
+	}
+	b, err := RequestResponse(host, msg.Route, msg.Body)
+	if err != nil {
+		reply.Error = err.Error()
+	} else {
+		reply.Body = b
+	}
+	return reply
+}
+
+// Handle a tunnel message the app received from a peer.
+// Call this function when a message sent with the tunnel sender arrives.
+// Requests are forwarded towards the developer, and replies back to whoever is waiting
+func HandleTunnelMessage(peer string, payload []byte) error {
+	var msg TunnelMsg
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return err
+	}
+	switch msg.Type {
+	case TunnelMsgRequest:
+		tunnelMtx.Lock()
+		host := tunnelDevHost
+		tunnelMtx.Unlock()
+		if host != "" {
+			// we're the developer's peer
+			go sendTunnelMsg(peer, forwardTunnel(host, msg))
+			return nil
+		}
+		up := gossipUpstream(msg.Gossip)
+		if up == "" {
+			return fmt.Errorf("No route to the developer for tunnel request %s", msg.ID)
+		}
+		tunnelMtx.Lock()
+		now := time.Now()
+		for id, hop := range tunnelFrom {
+			if now.Sub(hop.at) > TunnelTimeout {
+				delete(tunnelFrom, id)
+			}
+		}
+		tunnelFrom[msg.ID] = tunnelHop{peer: peer, at: now}
+		tunnelMtx.Unlock()
+		sendTunnelMsg(up, msg)
+	case TunnelMsgReply:
+		tunnelMtx.Lock()
+		hop, ok := tunnelFrom[msg.ID]
+		delete(tunnelFrom, msg.ID)
+		tunnelMtx.Unlock()
+		if ok {
+			sendTunnelMsg(hop.peer, msg)
+			return nil
+		}
+		// a reply to our own debora
+		_, err := NewClient(deboraHost).Tunnel(context.Background(), TunnelPoll{Pid: os.Getpid(), Replies: []TunnelMsg{msg}})
+		return err
+	default:
+		return fmt.Errorf("Unknown tunnel message type %q", msg.Type)
+	}
+	return nil
+}
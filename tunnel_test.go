@@ -0,0 +1,93 @@
+package debora
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+type tunnelResult struct {
+	body []byte
+	err  error
+}
+
+// Queue a request from the daemon, and return the channel its reply comes on
+func testTunnelRequest(route string) chan tunnelResult {
+	ch := make(chan tunnelResult, 1)
+	go func() {
+		b, err := tunnelRequest(&TunnelRoute{Peer: "dev"}, route, []byte(route), true)
+		ch <- tunnelResult{b, err}
+	}()
+	return ch
+}
+
+func waitTunnelReply(t *testing.T, ch chan tunnelResult, route string) {
+	select {
+	case r := <-ch:
+		if r.err != nil || string(r.body) != route+" ok" {
+			t.Fatalf("%s: got %q, %v", route, r.body, r.err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("no reply to %s", route)
+	}
+}
+
+// A lease queued while the reply to the handshake is handed back
+// must still reach the developer
+func TestTunnelReplyKeepsRequests(t *testing.T) {
+	setDuration(t, &TunnelTimeout, 10*time.Second)
+	setDuration(t, &TunnelPollTimeout, time.Second)
+
+	deb := &Debora{deb: AddRequest{Pid: os.Getpid()}}
+	srv := httptest.NewServer(http.HandlerFunc(deb.tunnel))
+	defer srv.Close()
+	oldHost := deboraHost
+	deboraHost = strings.TrimPrefix(srv.URL, "http://")
+	defer func() { deboraHost = oldHost }()
+	c := NewClient(deboraHost)
+	ctx := context.Background()
+
+	// the developer's peer answers each request
+	reply := func(msg TunnelMsg) {
+		b, _ := json.Marshal(TunnelMsg{Type: TunnelMsgReply, ID: msg.ID, Body: []byte(msg.Route + " ok")})
+		if err := HandleTunnelMessage("dev", b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	poll := func() []TunnelMsg {
+		resp, err := c.Tunnel(ctx, TunnelPoll{Pid: os.Getpid()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Requests
+	}
+
+	handshake := testTunnelRequest("handshake")
+	reqs := poll()
+	if len(reqs) != 1 || reqs[0].Route != "handshake" || reqs[0].Peer != "dev" {
+		t.Fatalf("expected the handshake, got %+v", reqs)
+	}
+
+	// the daemon asks for a lease before the handshake's reply is handed back
+	lease := testTunnelRequest("lease")
+	for deadline := time.Now().Add(5 * time.Second); len(tunnelOut) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("lease wasn't queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	reply(reqs[0])
+	waitTunnelReply(t, handshake, "handshake")
+
+	reqs = poll()
+	if len(reqs) != 1 || reqs[0].Route != "lease" {
+		t.Fatalf("expected the lease, got %+v", reqs)
+	}
+	reply(reqs[0])
+	waitTunnelReply(t, lease, "lease")
+}
@@ -1,12 +1,22 @@
 package debora
 
 import (
+	"io"
 	"os"
+	"sync"
+	"time"
 )
 
 // Debora daemon's main object for tracking processes and their developer's keys
 type Debora struct {
-	deb RequestObj
+	deb AddRequest
+
+	mtx      sync.Mutex
+	height   int64           // last height reported by the app
+	heightAt time.Time       // when the app last reported its height
+	pending  *UpgradeMsg     // upgrade built and waiting for activation
+	upgraded *RestartRequest // upgrade handed over by the old debora, finished once the app adds itself again
+	rep      *reporter       // reports the handed over upgrade to the developer
 }
 
 // DebMaster is the debora client within the
@@ -22,21 +32,25 @@ type DebMaster struct {
 // `debora call` on the developer's machine, and killed by the developer
 type DeveloperDebora struct {
 	priv string
+
+	mtx     sync.Mutex
+	leases  *leaseTable       // restart slots for coordinated restarts
+	tokens  map[string]string // peer id reporting with each handshake token, "" until it reports
+	reports map[string]Report // latest upgrade report from each peer, by peer id
+
+	handshakes int       // number of peers authenticated
+	lastSeen   time.Time // last handshake or report
 }
 
-// For communicating with the debora daemon
-// The same object is used for all communication
-// and for representing processes/apps.
-// So most of it is usually empty.
-type RequestObj struct {
-	Key     string   `json:",omitempty"` // hex encoded DER public key
-	Pid     int      `json:",omitempty"` // process id
-	Args    []string `json:",omitempty"` // command line call that started the process
-	App     string   `json:",omitempty"` // process name
-	Src     string   `json:",omitempty"` // install dir (cd to this before running git fetch. run `go install` from here)
-	Commit  string   `json:",omitempty"` // commit hash to fetch (this can also be other trigger words, eg. to update debora herself)
-	Host    string   `json:",omitempty"` // bootstrap node (developer's ip:port)
-	LogFile string   `json:",omitempty"` // directory to store upgrade logs
+// Status of the daemon, as reported by `debora status`
+type Status struct {
+	Version int
+	PeerID  string
+	App     string
+	Pid     int
+	Commit  string      `json:",omitempty"` // resolved commit the app runs, if debora upgraded it
+	Height  int64       `json:",omitempty"`
+	Pending *UpgradeMsg `json:",omitempty"` // upgrade waiting for activation
 }
 
 type Config struct {
@@ -53,6 +67,12 @@ var GlobalConfig = Config{
 	Apps: make(map[string]App),
 }
 
+func (d *Debora) Height() int64 {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.height
+}
+
 // Simple log to file interface
 
 func (d *Debora) LogFile() string {
@@ -80,3 +100,19 @@ func (d *Debora) Logf(s string) error {
 	logger.Printf(s)
 	return appendFile(d.LogFile(), s)
 }
+
+// Writer to the log, eg. for streaming command output
+func (d *Debora) logWriter() io.Writer {
+	return logWriter{d}
+}
+
+type logWriter struct {
+	d *Debora
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	// the output may contain %, so it's not passed as a format
+	logger.Printf("%s", p)
+	appendFile(w.d.LogFile(), string(p))
+	return len(p), nil
+}
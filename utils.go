@@ -1,17 +1,14 @@
 package debora
 
 import (
-	"bytes"
-	"encoding/hex"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
 	"os/user"
 	"path"
-	"strconv"
 	"syscall"
 )
 
@@ -104,30 +101,16 @@ func LoadConfig(configFile string) error {
 	return nil
 }
 
-// http json request and response
+// http json request and response, timing out after DefaultTimeout.
+// The daemon's routes are better called through a Client
 func RequestResponse(host, method string, body []byte) ([]byte, error) {
-	host = "http://" + host
-	req, err := http.NewRequest("POST", host+"/"+method, bytes.NewBuffer(body))
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return (&Client{Host: host}).post(context.Background(), method, body, DefaultTimeout)
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	contents, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-	if resp.StatusCode > 399 {
-		return nil, fmt.Errorf("HTTP error %d: %s", resp.StatusCode, contents)
-	}
-	return contents, nil
+// http json request and response, bounded by the context alone,
+// for routes that take longer, like a call that upgrades the app
+func RequestResponseContext(ctx context.Context, host, method string, body []byte) ([]byte, error) {
+	return (&Client{Host: host}).post(ctx, method, body, 0)
 }
 
 // Check if a process is running by sending it the 0 signal
@@ -211,8 +194,3 @@ func (l *Logger) Println(s ...interface{}) {
 		fmt.Println(f)
 	}
 }
-
-func isHex(str string) bool {
-	_, err := hex.DecodeString(str)
-	return err == nil
-}
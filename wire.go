@@ -0,0 +1,350 @@
+package debora
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"unicode/utf8"
+)
+
+/*
+	Binary encoding of the upgrade message.
+	Apps that carry the upgrade message in their own p2p messages
+	can use this instead of JSON: it is smaller, and canonical,
+	so a message has exactly one encoding and signatures over it are stable.
+	The encoding is the magic, the uvarint length of the body, and the body.
+	The body has every field of the message in declaration order:
+	integers as (signed) varints, strings (UTF-8) and byte slices as their uvarint length
+	and contents, lists as their uvarint length and items, and optional structs
+	as a 0 or 1 byte followed by the struct. Booleans are a 0 or 1 byte too.
+	Empty and absent lists are the same.
+	The decoder rejects anything but the encoding of the message it decodes to.
+	The magic names the format. Fields added by a format are only in its encoding,
+	and messages in older formats still decode, without them.
+*/
+
+// Magic of each format of the encoding.
+// Format 2 added Tunnel, and format 3 the artifact's Size
+var upgradeMagics = map[int]string{
+	1: "DBUPGRD1",
+	2: "DBUPGRD2",
+	3: "DBUPGRD3",
+}
+
+// The format EncodeUpgrade writes
+const upgradeFormat = 3
+
+// Prefix of the bytes signed for an upgrade message,
+// so they can't be mistaken for another signed message
+const upgradeSignPrefix = "debora upgrade signature v1\x00"
+
+// Encode the upgrade message in the canonical binary encoding
+func EncodeUpgrade(m UpgradeMsg) []byte {
+	return encodeUpgrade(m, upgradeFormat)
+}
+
+func encodeUpgrade(m UpgradeMsg, format int) []byte {
+	var body encoder
+	body.upgrade(m, format)
+	var e encoder
+	e.buf.WriteString(upgradeMagics[format])
+	e.uvarint(uint64(body.buf.Len()))
+	e.buf.Write(body.buf.Bytes())
+	return e.buf.Bytes()
+}
+
+// The format of a binary upgrade message, or 0 if it isn't one
+func binaryFormat(p []byte) int {
+	for format, magic := range upgradeMagics {
+		if bytes.HasPrefix(p, []byte(magic)) {
+			return format
+		}
+	}
+	return 0
+}
+
+// Decode an upgrade message from the canonical binary encoding, and validate it.
+// Messages in older formats are accepted too
+func DecodeUpgrade(p []byte) (UpgradeMsg, error) {
+	var m UpgradeMsg
+	format := binaryFormat(p)
+	if format == 0 {
+		return m, fmt.Errorf("Not a binary upgrade message")
+	}
+	d := decoder{p: p[len(upgradeMagics[format]):]}
+	n := d.uvarint()
+	if d.err == nil && n != uint64(len(d.p)) {
+		return m, fmt.Errorf("Bad upgrade message length %d, have %d bytes", n, len(d.p))
+	}
+	d.upgrade(&m, format)
+	if d.err != nil {
+		return m, fmt.Errorf("Bad upgrade message: %s", d.err.Error())
+	}
+	if len(d.p) > 0 {
+		return m, fmt.Errorf("Bad upgrade message: %d trailing bytes", len(d.p))
+	}
+	// eg. overlong varints
+	if !bytes.Equal(p, encodeUpgrade(m, format)) {
+		return m, fmt.Errorf("Upgrade message is not canonically encoded")
+	}
+	if m.Version > ProtocolVersion {
+		return m, fmt.Errorf("Unsupported protocol version %d", m.Version)
+	}
+	return m, m.validate()
+}
+
+// The bytes to sign for an upgrade message
+func UpgradeSignBytes(m UpgradeMsg) []byte {
+	return append([]byte(upgradeSignPrefix), EncodeUpgrade(m)...)
+}
+
+// Decode an upgrade payload, binary or json
+func decodeUpgrade(p []byte) (UpgradeMsg, error) {
+	if binaryFormat(p) != 0 {
+		return DecodeUpgrade(p)
+	}
+	var m UpgradeMsg
+	return m, decodeMsg(p, &m)
+}
+
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (e *encoder) uvarint(x uint64) {
+	b := make([]byte, binary.MaxVarintLen64)
+	e.buf.Write(b[:binary.PutUvarint(b, x)])
+}
+
+func (e *encoder) varint(x int64) {
+	b := make([]byte, binary.MaxVarintLen64)
+	e.buf.Write(b[:binary.PutVarint(b, x)])
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.uvarint(uint64(len(b)))
+	e.buf.Write(b)
+}
+
+func (e *encoder) string(s string) {
+	e.uvarint(uint64(len(s)))
+	e.buf.WriteString(s)
+}
+
+func (e *encoder) strings(ss []string) {
+	e.uvarint(uint64(len(ss)))
+	for _, s := range ss {
+		e.string(s)
+	}
+}
+
+func (e *encoder) present(ok bool) bool {
+	if ok {
+		e.buf.WriteByte(1)
+	} else {
+		e.buf.WriteByte(0)
+	}
+	return ok
+}
+
+func (e *encoder) upgrade(m UpgradeMsg, format int) {
+	e.varint(int64(m.Version))
+	e.string(m.Host)
+	e.string(m.Commit)
+	e.uvarint(uint64(len(m.Directives)))
+	for _, d := range m.Directives {
+		e.string(d.Op)
+		e.string(d.Commit)
+		e.strings(d.Args)
+	}
+	e.varint(m.ActivateAt)
+	e.varint(m.ActivateHeight)
+	e.varint(int64(m.MaxDown))
+	e.varint(int64(m.Percent))
+	e.strings(m.Include)
+	e.strings(m.Exclude)
+	if a := m.Artifact; e.present(a != nil) {
+		e.string(a.Name)
+		e.string(a.SHA256)
+		e.strings(a.URLs)
+		e.string(a.Sig)
+		if format >= 3 {
+			e.varint(a.Size)
+		}
+		e.uvarint(uint64(len(a.Deltas)))
+		for _, d := range a.Deltas {
+			e.string(d.From)
+			e.string(d.URL)
+		}
+		if mf := a.Manifest; e.present(mf != nil) {
+			e.varint(mf.Size)
+			e.varint(int64(mf.ChunkSize))
+			e.strings(mf.Chunks)
+			e.string(mf.Root)
+			e.string(mf.Sig)
+		}
+	}
+	if b := m.Bundle; e.present(b != nil) {
+		e.string(b.SHA256)
+		e.string(b.Sig)
+		e.bytes(b.Data)
+		e.strings(b.URLs)
+	}
+	e.string(m.BinarySHA256)
+	e.string(m.Toolchain)
+	if format >= 2 {
+		e.present(m.Tunnel)
+	}
+}
+
+// Reads from p until the first error
+type decoder struct {
+	p   []byte
+	err error
+}
+
+func (d *decoder) fail(format string, a ...interface{}) {
+	if d.err == nil {
+		d.err = fmt.Errorf(format, a...)
+	}
+	d.p = nil
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(d.p)
+	if n <= 0 {
+		d.fail("bad uvarint")
+		return 0
+	}
+	d.p = d.p[n:]
+	return x
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	x, n := binary.Varint(d.p)
+	if n <= 0 {
+		d.fail("bad varint")
+		return 0
+	}
+	d.p = d.p[n:]
+	return x
+}
+
+func (d *decoder) int() int {
+	x := d.varint()
+	if int64(int(x)) != x {
+		d.fail("int %d out of range", x)
+		return 0
+	}
+	return int(x)
+}
+
+// A length, which can't be more than the bytes left,
+// since every item takes at least one
+func (d *decoder) len() int {
+	n := d.uvarint()
+	if n > uint64(len(d.p)) {
+		d.fail("length %d exceeds the %d bytes left", n, len(d.p))
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.len()
+	if n == 0 {
+		return nil
+	}
+	b := make([]byte, n)
+	copy(b, d.p)
+	d.p = d.p[n:]
+	return b
+}
+
+// Strings must be UTF-8, like in the JSON encoding of the message
+func (d *decoder) string() string {
+	n := d.len()
+	if !utf8.Valid(d.p[:n]) {
+		d.fail("string is not valid UTF-8")
+		return ""
+	}
+	s := string(d.p[:n])
+	d.p = d.p[n:]
+	return s
+}
+
+func (d *decoder) strings() []string {
+	n := d.len()
+	if n == 0 {
+		return nil
+	}
+	ss := make([]string, n)
+	for i := range ss {
+		ss[i] = d.string()
+	}
+	return ss
+}
+
+func (d *decoder) present() bool {
+	if d.err != nil {
+		return false
+	}
+	if len(d.p) == 0 {
+		d.fail("unexpected end of message")
+		return false
+	}
+	b := d.p[0]
+	d.p = d.p[1:]
+	if b > 1 {
+		d.fail("bad presence byte %d", b)
+	}
+	return b == 1
+}
+
+func (d *decoder) upgrade(m *UpgradeMsg, format int) {
+	m.Version = d.int()
+	m.Host = d.string()
+	m.Commit = d.string()
+	if n := d.len(); n > 0 {
+		m.Directives = make([]Directive, n)
+		for i := range m.Directives {
+			m.Directives[i] = Directive{Op: d.string(), Commit: d.string(), Args: d.strings()}
+		}
+	}
+	m.ActivateAt = d.varint()
+	m.ActivateHeight = d.varint()
+	m.MaxDown = d.int()
+	m.Percent = d.int()
+	m.Include = d.strings()
+	m.Exclude = d.strings()
+	if d.present() {
+		a := &Artifact{Name: d.string(), SHA256: d.string(), URLs: d.strings(), Sig: d.string()}
+		if format >= 3 {
+			a.Size = d.varint()
+		}
+		if n := d.len(); n > 0 {
+			a.Deltas = make([]Delta, n)
+			for i := range a.Deltas {
+				a.Deltas[i] = Delta{From: d.string(), URL: d.string()}
+			}
+		}
+		if d.present() {
+			a.Manifest = &Manifest{Size: d.varint(), ChunkSize: d.int(), Chunks: d.strings(), Root: d.string(), Sig: d.string()}
+		}
+		m.Artifact = a
+	}
+	if d.present() {
+		m.Bundle = &Bundle{SHA256: d.string(), Sig: d.string(), Data: d.bytes(), URLs: d.strings()}
+	}
+	m.BinarySHA256 = d.string()
+	m.Toolchain = d.string()
+	if format >= 2 {
+		m.Tunnel = d.present()
+	}
+}
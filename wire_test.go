@@ -0,0 +1,112 @@
+package debora
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func testUpgradeMsg() UpgradeMsg {
+	return UpgradeMsg{
+		Version:    ProtocolVersion,
+		Host:       "10.0.0.1:56565",
+		Commit:     "v1.4.2",
+		Directives: []Directive{{Op: DirectiveUpgradeApp, Commit: "v1.4.2"}, {Op: DirectiveSetArgs, Args: []string{"--fast"}}},
+		MaxDown:    2,
+		Include:    []string{"abcd"},
+		Artifact: &Artifact{
+			Name:   "node",
+			SHA256: "8a5edab282632443219e051e4ade2d1d5bbc671c781051bf1437897cbdfea0f1",
+			URLs:   []string{"https://example.com/node"},
+			Sig:    "3045",
+			Size:   1 << 20,
+		},
+		Toolchain: "go1.21.0",
+		Tunnel:    true,
+	}
+}
+
+func TestEncodeUpgradeRoundTrip(t *testing.T) {
+	m := testUpgradeMsg()
+	p := EncodeUpgrade(m)
+	if !bytes.HasPrefix(p, []byte(upgradeMagics[upgradeFormat])) {
+		t.Fatalf("missing magic %s", upgradeMagics[upgradeFormat])
+	}
+	got, err := DecodeUpgrade(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(EncodeUpgrade(got), p) {
+		t.Fatalf("round trip changed the message: %+v", got)
+	}
+	if !got.Tunnel {
+		t.Fatal("lost the tunnel flag")
+	}
+}
+
+// Messages from peers that predate the newer fields still decode, without them
+func TestDecodeUpgradeOldFormats(t *testing.T) {
+	for format := 1; format < upgradeFormat; format++ {
+		m := testUpgradeMsg()
+		m.Version = format
+		if format < 2 {
+			m.Tunnel = false
+		}
+		if format < 3 {
+			m.Artifact.Size = 0
+		}
+		p := encodeUpgrade(m, format)
+		if !bytes.HasPrefix(p, []byte(upgradeMagics[format])) {
+			t.Fatalf("format %d should use the %s magic", format, upgradeMagics[format])
+		}
+		got, err := DecodeUpgrade(p)
+		if err != nil {
+			t.Fatalf("format %d: %v", format, err)
+		}
+		if got.Commit != m.Commit || got.Artifact == nil || got.Artifact.Name != "node" || got.Tunnel != m.Tunnel {
+			t.Fatalf("bad format %d decode: %+v", format, got)
+		}
+		if _, err := decodeUpgrade(p); err != nil {
+			t.Fatalf("format %d: %v", format, err)
+		}
+
+		// a newer body under an older magic has trailing bytes
+		newer := encodeUpgrade(testUpgradeMsg(), format+1)
+		if _, err := DecodeUpgrade(append([]byte(upgradeMagics[format]), newer[len(upgradeMagics[format+1]):]...)); err == nil {
+			t.Fatalf("format %d body accepted as format %d", format+1, format)
+		}
+	}
+}
+
+// Whatever the decoder accepts is the canonical encoding of its message,
+// and survives a trip through JSON unchanged
+func FuzzDecodeUpgrade(f *testing.F) {
+	for format := 1; format <= upgradeFormat; format++ {
+		m := testUpgradeMsg()
+		m.Version = format
+		f.Add(encodeUpgrade(m, format))
+		f.Add(encodeUpgrade(UpgradeMsg{Version: format, Commit: "v1"}, format))
+	}
+	f.Add([]byte(upgradeMagics[upgradeFormat]))
+	f.Fuzz(func(t *testing.T, p []byte) {
+		m, err := DecodeUpgrade(p)
+		if err != nil {
+			return
+		}
+		format := binaryFormat(p)
+		if !bytes.Equal(encodeUpgrade(m, format), p) {
+			t.Fatalf("accepted a message that doesn't re-encode to its bytes: %+v", m)
+		}
+		b, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got UpgradeMsg
+		if err := decodeMsg(b, &got); err != nil {
+			t.Fatalf("json of an accepted message doesn't decode: %v", err)
+		}
+		if !bytes.Equal(encodeUpgrade(got, format), p) {
+			t.Fatalf("json round trip changed the message: %+v", got)
+		}
+	})
+}
@@ -0,0 +1,150 @@
+package debora
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+)
+
+/*
+	Isolated builds.
+	Upgrades are checked out and built in a git worktree under the debora root,
+	one per commit, so the operator's own checkout is never touched
+	and local edits can never block an upgrade.
+	Only the last WorktreeRetention worktrees of an app are kept,
+	along with the one running now.
+*/
+
+// Number of worktrees kept for each app
+var WorktreeRetention = 3
+
+// Directory holding an app's worktrees
+func worktreesDir(app string) string {
+	return path.Join(DeboraRoot, "worktrees", app)
+}
+
+// Run git in dir, logging its output
+func (deb *Debora) git(dir string, args ...string) (string, error) {
+	buf := new(bytes.Buffer)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Stdout = buf
+	cmd.Stderr = buf
+	err := cmd.Run()
+	out := buf.String()
+	if err != nil {
+		deb.Logf(out)
+		return out, fmt.Errorf("Git %s error: %s", args[0], err.Error())
+	}
+	return out, nil
+}
+
+// Fetch the commit into src's repo and check it out in its own worktree.
+// hash may be any reference resolveRef understands.
+// With a bundle, the commits are fetched from it instead of origin.
+// Returns the worktree's path
+func (deb *Debora) upgradeWorktree(app, src, hash string, bundle *Bundle) (string, error) {
+	// fetching only touches the repo's refs and objects, not the working copy
+	if bundle != nil {
+		if err := deb.fetchBundle(app, src, hash, bundle); err != nil {
+			return "", err
+		}
+	} else {
+		out, err := deb.git(src, "fetch", "-a", "--tags", "origin")
+		if err != nil {
+			return "", err
+		}
+		deb.Logf(out)
+	}
+
+	// key the worktree by the full commit hash
+	commit, err := deb.resolveRef(src, hash)
+	if err != nil {
+		return "", err
+	}
+
+	dir := path.Join(worktreesDir(app), commit)
+	if _, err := os.Stat(dir); err == nil {
+		// already checked out. make sure it's still pristine
+		deb.Logf(fmt.Sprintf("Reusing worktree %s\n", dir))
+		if _, err := deb.git(dir, "checkout", "--force", "--detach", commit); err != nil {
+			return "", err
+		}
+		if _, err := deb.git(dir, "clean", "-fdx"); err != nil {
+			return "", err
+		}
+		return dir, nil
+	}
+
+	if err := os.MkdirAll(worktreesDir(app), 0700); err != nil {
+		return "", err
+	}
+	// clear stale worktree records, eg. if a directory was removed by hand
+	deb.git(src, "worktree", "prune")
+	if _, err := deb.git(src, "worktree", "add", "--detach", dir, commit); err != nil {
+		return "", err
+	}
+	deb.Logf(fmt.Sprintf("Checked out %s in %s\n", commit, dir))
+	return dir, nil
+}
+
+// Remove all but the newest WorktreeRetention worktrees,
+// never removing those in keep
+func (deb *Debora) gcWorktrees(app, src string, keep ...string) {
+	dir := worktreesDir(app)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	// newest first
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().After(files[j].ModTime())
+	})
+	kept := 0
+	for _, f := range files {
+		if !f.IsDir() {
+			continue
+		}
+		wt := path.Join(dir, f.Name())
+		if kept < WorktreeRetention || isIn(wt, keep) {
+			kept++
+			continue
+		}
+		deb.Logf(fmt.Sprintf("Removing old worktree %s\n", wt))
+		if _, err := deb.git(src, "worktree", "remove", "--force", wt); err != nil {
+			os.RemoveAll(wt)
+		}
+	}
+	deb.git(src, "worktree", "prune")
+}
+
+// The commit the app is running, if debora upgraded it
+func runningCommit(app string) string {
+	b, err := ioutil.ReadFile(path.Join(worktreesDir(app), "HEAD"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// Record the commit the app is now running
+func writeRunningCommit(app, commit string) error {
+	if err := os.MkdirAll(worktreesDir(app), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(worktreesDir(app), "HEAD"), []byte(commit), 0600)
+}
+
+func isIn(s string, list []string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}